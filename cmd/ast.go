@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/spf13/cobra"
+)
+
+var (
+	astFormat string
+	astShell  bool
+)
+
+func init() {
+	astCmd.Flags().StringVar(&astFormat, "format", "json", "Output format: json or tree")
+	astCmd.Flags().BoolVar(&astShell, "shell", false, "Include the parsed shell syntax tree of RUN bodies")
+	rootCmd.AddCommand(astCmd)
+}
+
+var astCmd = &cobra.Command{
+	Use:   "ast [Dockerfile]",
+	Short: "Print the syntax tree dockerfmt parses from a Dockerfile",
+	Long:  `Print the syntax tree dockerfmt parses from a Dockerfile, as JSON or an indented tree. If no file is specified, input is read from stdin.`,
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if astFormat != "json" && astFormat != "tree" {
+			fatalf("Error: unknown format %q (want json or tree)", astFormat)
+		}
+
+		inputName := "stdin"
+		var inputBytes []byte
+		var err error
+		if len(args) == 0 {
+			inputBytes, err = io.ReadAll(os.Stdin)
+		} else {
+			inputName = args[0]
+			inputBytes, err = os.ReadFile(inputName)
+		}
+		if err != nil {
+			fatalf("Failed to read %s: %v", inputName, err)
+		}
+
+		ast, err := lib.ParseAST(inputBytes, lib.ASTOptions{Shell: astShell})
+		if err != nil {
+			fatalf("Failed to parse %s: %v", inputName, err)
+		}
+		if err := printAST(os.Stdout, ast, astFormat); err != nil {
+			fatalf("Failed to write to stdout: %v", err)
+		}
+	},
+}
+
+func printAST(w io.Writer, ast *lib.ASTNode, format string) error {
+	if format == "tree" {
+		return ast.WriteTree(w)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ast); err != nil {
+		return fmt.Errorf("encoding JSON: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reteps/dockerfmt/lib"
+)
+
+// cacheMaxAge is how long an entry stays in the cache without being used.
+const cacheMaxAge = 30 * 24 * time.Hour
+
+// formatCache remembers inputs that are already formatted, so --cache can
+// skip them. An entry is the hash of the dockerfmt version, the resolved
+// Config, the kind of file and its contents, so changing any of them is a
+// miss.
+type formatCache struct {
+	path    string
+	version string
+	// entries maps each hash to the Unix time it was last used.
+	entries map[string]int64
+	dirty   bool
+}
+
+// cacheFile is the on-disk form of formatCache.
+type cacheFile struct {
+	Version   string           `json:"version"`
+	Formatted map[string]int64 `json:"formatted"`
+}
+
+// defaultCachePath returns the cache file under the user's cache directory.
+func defaultCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dockerfmt", "cache.json"), nil
+}
+
+// loadCache reads the cache at path. A missing or unreadable cache, or one
+// written by another version of dockerfmt, starts out empty and is replaced
+// when saved.
+func loadCache(path string) *formatCache {
+	c := &formatCache{path: path, version: cacheVersion(), entries: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	var f cacheFile
+	if json.Unmarshal(data, &f) != nil || f.Version != c.version || f.Formatted == nil {
+		c.dirty = true
+		return c
+	}
+	c.entries = f.Formatted
+	return c
+}
+
+// cacheVersion identifies the dockerfmt build that formatted the cached
+// inputs. Development builds all report Version "dev", so the executable's
+// own hash tells them apart.
+func cacheVersion() string {
+	if Version != "dev" {
+		return Version
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return Version
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		return Version
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return Version
+	}
+	return Version + "+" + hex.EncodeToString(h.Sum(nil))
+}
+
+// key returns the cache key of the input name with contents data, formatted
+// with config.
+func (c *formatCache) key(name string, data []byte, config *lib.Config) string {
+	h := sha256.New()
+	// The config can't fail to encode: it only holds strings, numbers,
+	// booleans, slices and a string-keyed map.
+	configJSON, _ := json.Marshal(config)
+	kind := embeddedKind(name)
+	if isDockerignore(name) {
+		kind = "dockerignore"
+	}
+	for _, part := range [][]byte{[]byte(c.version), configJSON, []byte(kind), data} {
+		// Length-prefix each part so their boundaries are unambiguous.
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(part))))
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// formatted reports whether the input with key is known to be formatted,
+// marking the entry as used.
+func (c *formatCache) formatted(key string) bool {
+	if _, ok := c.entries[key]; !ok {
+		return false
+	}
+	c.entries[key] = time.Now().Unix()
+	c.dirty = true
+	return true
+}
+
+// add records that the input with key is formatted.
+func (c *formatCache) add(key string) {
+	c.entries[key] = time.Now().Unix()
+	c.dirty = true
+}
+
+// save writes the cache if it changed, dropping entries that haven't been
+// used for cacheMaxAge. The file is replaced atomically so that concurrent
+// runs never see a partial cache.
+func (c *formatCache) save() error {
+	if !c.dirty {
+		return nil
+	}
+	cutoff := time.Now().Add(-cacheMaxAge).Unix()
+	for key, used := range c.entries {
+		if used < cutoff {
+			delete(c.entries, key)
+		}
+	}
+	data, err := json.Marshal(cacheFile{Version: c.version, Formatted: c.entries})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	c := &formatCache{version: "1.0.0"}
+	data := []byte("FROM a\n")
+	config := &lib.Config{IndentSize: 4, TrailingNewline: true}
+	key := c.key("Dockerfile", data, config)
+
+	// The key only depends on its inputs.
+	assert.Equal(t, key, c.key("Dockerfile", data, &lib.Config{IndentSize: 4, TrailingNewline: true}))
+	assert.Equal(t, key, (&formatCache{version: "1.0.0"}).key("Dockerfile", data, config))
+	assert.Equal(t, key, c.key("app/Dockerfile.dev", data, config))
+
+	tests := []struct {
+		name   string
+		cache  *formatCache
+		input  string
+		data   []byte
+		config *lib.Config
+	}{
+		{"version", &formatCache{version: "1.0.1"}, "Dockerfile", data, config},
+		{"config", c, "Dockerfile", data, &lib.Config{IndentSize: 2, TrailingNewline: true}},
+		{"rules", c, "Dockerfile", data, &lib.Config{IndentSize: 4, TrailingNewline: true, Rules: map[string]bool{lib.RuleJSONSpacing: false}}},
+		{"contents", c, "Dockerfile", []byte("FROM b\n"), config},
+		{"dockerignore", c, ".dockerignore", data, config},
+		{"embedded", c, "docker-compose.yml", data, config},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NotEqual(t, key, tt.cache.key(tt.input, tt.data, tt.config))
+		})
+	}
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dockerfmt", "cache.json")
+	c := loadCache(path)
+	assert.Empty(t, c.entries)
+	assert.False(t, c.formatted("a"))
+
+	// An unchanged cache isn't written.
+	require.NoError(t, c.save())
+	assert.NoFileExists(t, path)
+
+	c.add("a")
+	require.NoError(t, c.save())
+	c = loadCache(path)
+	assert.True(t, c.formatted("a"))
+	assert.False(t, c.formatted("b"))
+}
+
+func TestCacheInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"corrupt", "{not json"},
+		{"truncated", `{"version":`},
+		{"other version", `{"version":"0.0.1","formatted":{"a":1}}`},
+		{"no entries", `{"version":"` + cacheVersion() + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.contents), 0o644))
+
+			c := loadCache(path)
+			assert.Empty(t, c.entries)
+			assert.False(t, c.formatted("a"))
+			// The bad cache is replaced even if nothing is added to it.
+			require.NoError(t, c.save())
+			assert.Empty(t, loadCache(path).entries)
+			assert.False(t, loadCache(path).dirty)
+		})
+	}
+}
+
+func TestCachePrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	now := time.Now()
+	c := &formatCache{
+		path:    path,
+		version: cacheVersion(),
+		entries: map[string]int64{
+			"old":    now.Add(-cacheMaxAge - time.Hour).Unix(),
+			"recent": now.Add(-cacheMaxAge + time.Hour).Unix(),
+			"used":   now.Add(-cacheMaxAge - time.Hour).Unix(),
+		},
+		dirty: true,
+	}
+	// Using an entry keeps it.
+	assert.True(t, c.formatted("used"))
+	require.NoError(t, c.save())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var f cacheFile
+	require.NoError(t, json.Unmarshal(data, &f))
+	assert.Equal(t, cacheVersion(), f.Version)
+	assert.ElementsMatch(t, []string{"recent", "used"}, slices.Collect(maps.Keys(f.Formatted)))
+}
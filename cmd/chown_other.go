@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// chown is a no-op where files have no Unix owner.
+func chown(f *os.File, info os.FileInfo) {}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/reteps/dockerfmt/lib"
+)
+
+// isDockerignore reports whether name is a .dockerignore file, including the
+// per-Dockerfile kind such as Dockerfile.dockerignore.
+func isDockerignore(name string) bool {
+	return strings.HasSuffix(strings.ToLower(filepath.Base(name)), ".dockerignore")
+}
+
+// inputProblems returns the problems found in an input that formatting leaves
+// in place: those LintDockerignore finds in a .dockerignore file, and the
+// invalid RUN --mount flags of a Dockerfile.
+func inputProblems(inputName string, inputBytes []byte) []lib.Diagnostic {
+	if isDockerignore(inputName) {
+		return lib.LintDockerignore(inputBytes)
+	}
+	if embeddedKind(inputName) != "" {
+		return nil
+	}
+	// A Dockerfile that doesn't parse is reported when it is formatted.
+	diagnostics, _ := lib.LintMounts(inputBytes)
+	return diagnostics
+}
+
+// reportProblems prints the problems of an input: with --check on stdout,
+// like unformatted files, otherwise as warnings. It returns how many there
+// were.
+func reportProblems(inputName string, diagnostics []lib.Diagnostic) int {
+	for _, d := range diagnostics {
+		if checkFlag {
+			fmt.Printf("%s:%d: %s (%s)\n", inputName, d.Line, d.Message, d.Rule)
+		} else {
+			log.Printf("Warning: %s:%d: %s (%s)", inputName, d.Line, d.Message, d.Rule)
+		}
+	}
+	return len(diagnostics)
+}
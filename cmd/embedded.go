@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/reteps/dockerfmt/lib"
+)
+
+var (
+	// reComposeFile matches Compose file names such as compose.yaml and
+	// docker-compose.override.yml.
+	reComposeFile = regexp.MustCompile(`^(docker-)?compose(\..+)?\.ya?ml$`)
+	// reBakeFile matches bake file names such as docker-bake.hcl and
+	// docker-bake.override.json.
+	reBakeFile = regexp.MustCompile(`^docker-bake(\..+)?\.(hcl|json)$`)
+)
+
+// Kinds of files with embedded Dockerfiles.
+const (
+	markdownFile = "markdown"
+	composeFile  = "compose"
+	bakeHCLFile  = "bake-hcl"
+	bakeJSONFile = "bake-json"
+)
+
+// embeddedKind returns the kind of file name is if it embeds Dockerfiles, or
+// "" if it is a Dockerfile itself.
+func embeddedKind(name string) string {
+	base := strings.ToLower(filepath.Base(name))
+	switch ext := filepath.Ext(base); {
+	case ext == ".md" || ext == ".markdown":
+		return markdownFile
+	case reComposeFile.MatchString(base):
+		return composeFile
+	case reBakeFile.MatchString(base) && ext == ".hcl":
+		return bakeHCLFile
+	case reBakeFile.MatchString(base):
+		return bakeJSONFile
+	}
+	return ""
+}
+
+// embeddedFormat returns the function that formats the Dockerfiles embedded
+// in the file name, or nil if name is a Dockerfile itself.
+func embeddedFormat(f *lib.Formatter, name string) func([]byte) ([]byte, []lib.EmbeddedDockerfile, error) {
+	switch embeddedKind(name) {
+	case markdownFile:
+		return func(src []byte) ([]byte, []lib.EmbeddedDockerfile, error) {
+			out, blocks := f.FormatMarkdown(src)
+			return out, blocks, nil
+		}
+	case composeFile:
+		return f.FormatCompose
+	case bakeHCLFile:
+		return func(src []byte) ([]byte, []lib.EmbeddedDockerfile, error) {
+			out, blocks := f.FormatBakeHCL(src)
+			return out, blocks, nil
+		}
+	case bakeJSONFile:
+		return f.FormatBakeJSON
+	}
+	return nil
+}
+
+// editorConfigPath returns the path whose EditorConfig settings apply to the
+// input name: for a file with embedded Dockerfiles, a Dockerfile next to it.
+func editorConfigPath(name string) string {
+	if embeddedKind(name) != "" {
+		return filepath.Join(filepath.Dir(name), "Dockerfile")
+	}
+	return name
+}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/reteps/dockerfmt/lib"
+)
+
+// reHunkHeader matches the header of a diff hunk, capturing the start and
+// length of its lines in the new version of the file.
+var reHunkHeader = regexp.MustCompile(`(?m)^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// isDockerfile reports whether name looks like a Dockerfile, following the
+// pattern of the pre-commit hook: Dockerfile, Dockerfile.dev, app.dockerfile,
+// Containerfile and so on.
+func isDockerfile(name string) bool {
+	base := strings.ToLower(filepath.Base(name))
+	return strings.Contains(base, "dockerfile") || strings.Contains(base, "containerfile")
+}
+
+// gitChange is a Dockerfile that git reports as changed.
+type gitChange struct {
+	path string
+	// untracked is set for new files git doesn't know about yet.
+	untracked bool
+}
+
+// gitDiffTarget returns the diff arguments that select the changes to format:
+// the index against HEAD with staged, otherwise the working tree against ref.
+func gitDiffTarget(ref string, staged bool) []string {
+	if staged {
+		return []string{"--cached"}
+	}
+	return []string{ref}
+}
+
+// gitChangedDockerfiles returns the Dockerfiles changed relative to ref, or
+// staged in the index with staged set, as paths relative to the working
+// directory. Untracked files count as changed unless staged is set.
+func gitChangedDockerfiles(ref string, staged bool) ([]gitChange, error) {
+	top, err := runGit("", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	top = strings.TrimSpace(top)
+
+	var changes []gitChange
+	add := func(out string, untracked bool) {
+		for _, name := range strings.Split(out, "\x00") {
+			if name == "" || !isDockerfile(name) {
+				continue
+			}
+			path := filepath.Join(top, filepath.FromSlash(name))
+			if wd, err := os.Getwd(); err == nil {
+				if rel, err := filepath.Rel(wd, path); err == nil {
+					path = rel
+				}
+			}
+			changes = append(changes, gitChange{path, untracked})
+		}
+	}
+
+	args := append([]string{"diff", "--name-only", "-z", "--diff-filter=ACMR"}, gitDiffTarget(ref, staged)...)
+	out, err := runGit(top, append(args, "--")...)
+	if err != nil {
+		return nil, err
+	}
+	add(out, false)
+	if !staged {
+		out, err := runGit(top, "ls-files", "--others", "--exclude-standard", "-z")
+		if err != nil {
+			return nil, err
+		}
+		add(out, true)
+	}
+	return changes, nil
+}
+
+// gitChangedLines returns the lines of path that changed relative to ref, or
+// in the index with staged set. A deletion marks the lines on either side.
+func gitChangedLines(path, ref string, staged bool) ([]lib.LineRange, error) {
+	args := append([]string{"diff", "-U0", "--no-color", "--no-ext-diff"}, gitDiffTarget(ref, staged)...)
+	out, err := runGit("", append(args, "--", path)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseHunks(out), nil
+}
+
+// parseHunks returns the lines of the new file covered by the hunks of a
+// unified diff with no context lines.
+func parseHunks(diff string) []lib.LineRange {
+	var ranges []lib.LineRange
+	for _, m := range reHunkHeader.FindAllStringSubmatch(diff, -1) {
+		start, _ := strconv.Atoi(m[1])
+		count := 1
+		if m[2] != "" {
+			count, _ = strconv.Atoi(m[2])
+		}
+		if count == 0 {
+			ranges = append(ranges, lib.LineRange{Start: max(start, 1), End: start + 1})
+			continue
+		}
+		ranges = append(ranges, lib.LineRange{Start: start, End: start + count - 1})
+	}
+	return ranges
+}
+
+// gitHasUnstagedChanges reports whether the working tree copy of path differs
+// from the index.
+func gitHasUnstagedChanges(path string) (bool, error) {
+	out, err := runGit("", "diff", "--name-only", "--no-ext-diff", "--", path)
+	if err != nil {
+		return false, err
+	}
+	return out != "", nil
+}
+
+// runGit runs git with args in dir, or the working directory if dir is empty,
+// and returns its output.
+func runGit(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
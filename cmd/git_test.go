@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		diff     string
+		expected []lib.LineRange
+	}{
+		{"none", "", nil},
+		{"one line", "@@ -3 +3 @@\n-a\n+b\n", []lib.LineRange{{Start: 3, End: 3}}},
+		{"several lines", "@@ -2,0 +3,4 @@\n", []lib.LineRange{{Start: 3, End: 6}}},
+		{"deletion", "@@ -4,2 +3,0 @@\n", []lib.LineRange{{Start: 3, End: 4}}},
+		{"deletion at start", "@@ -1 +0,0 @@\n", []lib.LineRange{{Start: 1, End: 1}}},
+		{
+			"several hunks",
+			"diff --git a/Dockerfile b/Dockerfile\n--- a/Dockerfile\n+++ b/Dockerfile\n@@ -1 +1 @@ FROM a\n-x\n+y\n@@ -10,2 +10,3 @@\n",
+			[]lib.LineRange{{Start: 1, End: 1}, {Start: 10, End: 12}},
+		},
+		{"not a header", "+@@ -1 +1 @@\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseHunks(tt.diff))
+		})
+	}
+}
+
+// newGitRepo creates a git repository with a committed Dockerfile and makes it
+// the working directory for the rest of the test.
+func newGitRepo(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Chdir(t.TempDir())
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	git(t, "init", "-q")
+	git(t, "config", "user.name", "test")
+	git(t, "config", "user.email", "test@example.com")
+	writeFile(t, "Dockerfile", "FROM a\nRUN echo 1\nRUN echo 2\n")
+	writeFile(t, "README", "readme\n")
+	git(t, "add", ".")
+	git(t, "commit", "-q", "-m", "initial")
+}
+
+func git(t *testing.T, args ...string) {
+	t.Helper()
+	_, err := runGit("", args...)
+	require.NoError(t, err)
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+	require.NoError(t, os.WriteFile(name, []byte(contents), 0o644))
+}
+
+func TestGitChangedRef(t *testing.T) {
+	newGitRepo(t)
+	writeFile(t, "Dockerfile", "FROM a\nRUN echo 1\nrun echo changed\n")
+	writeFile(t, "README", "changed\n")
+	writeFile(t, "app/Containerfile", "FROM b\n")
+
+	changes, err := gitChangedDockerfiles("HEAD", false)
+	require.NoError(t, err)
+	assert.Equal(t, []gitChange{{"Dockerfile", false}, {filepath.Join("app", "Containerfile"), true}}, changes)
+
+	ranges, err := gitChangedLines("Dockerfile", "HEAD", false)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.LineRange{{Start: 3, End: 3}}, ranges)
+
+	// Changes that were committed no longer count against HEAD, but do
+	// against an earlier ref.
+	git(t, "add", ".")
+	git(t, "commit", "-q", "-m", "second")
+	changes, err = gitChangedDockerfiles("HEAD", false)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+	ranges, err = gitChangedLines("Dockerfile", "HEAD~1", false)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.LineRange{{Start: 3, End: 3}}, ranges)
+}
+
+func TestGitChangedStaged(t *testing.T) {
+	newGitRepo(t)
+	writeFile(t, "Dockerfile", "run echo 0\nFROM a\nRUN echo 1\nRUN echo 2\n")
+	writeFile(t, "other.dockerfile", "FROM b\n")
+	git(t, "add", "Dockerfile")
+
+	// Untracked and unstaged files don't count.
+	changes, err := gitChangedDockerfiles("HEAD", true)
+	require.NoError(t, err)
+	assert.Equal(t, []gitChange{{"Dockerfile", false}}, changes)
+
+	ranges, err := gitChangedLines("Dockerfile", "HEAD", true)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.LineRange{{Start: 1, End: 1}}, ranges)
+
+	unstaged, err := gitHasUnstagedChanges("Dockerfile")
+	require.NoError(t, err)
+	assert.False(t, unstaged)
+
+	writeFile(t, "Dockerfile", "run echo 0\nFROM a\nRUN echo 1\nRUN echo 2\nRUN echo 3\n")
+	unstaged, err = gitHasUnstagedChanges("Dockerfile")
+	require.NoError(t, err)
+	assert.True(t, unstaged)
+
+	// The staged ranges ignore the unstaged edit.
+	ranges, err = gitChangedLines("Dockerfile", "HEAD", true)
+	require.NoError(t, err)
+	assert.Equal(t, []lib.LineRange{{Start: 1, End: 1}}, ranges)
+}
@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/editorconfig/editorconfig-core-go/v2"
 	"github.com/reteps/dockerfmt/lib"
@@ -16,9 +20,37 @@ import (
 var (
 	writeFlag      bool
 	checkFlag      bool
+	verifyFlag     bool
 	newlineFlag    bool
 	indentSize     uint
+	useTabs        bool
 	spaceRedirects bool
+	lineEnding     string
+	stripBOM       bool
+	stdinFilename  string
+	backupSuffix   string
+	cacheFlag      bool
+	cacheLocation  string
+
+	gitChanged   string
+	gitStaged    bool
+	changedLines bool
+
+	maxBlankLines         uint
+	blankLineBeforeStage  bool
+	groupDirectives       []string
+	trimLeadingBlankLines bool
+
+	enableRules    []string
+	disableRules   []string
+	listRules      bool
+	keepMaintainer bool
+
+	commentSpace   bool
+	reflowComments bool
+	lineWidth      uint
+
+	sortDockerignore bool
 )
 
 var rootCmd = &cobra.Command{
@@ -30,51 +62,286 @@ var rootCmd = &cobra.Command{
 }
 
 func Run(cmd *cobra.Command, args []string) {
-	config := &lib.Config{
-		IndentSize:      indentSize,
-		TrailingNewline: newlineFlag,
-		SpaceRedirects:  spaceRedirects,
+	if listRules {
+		printRules(os.Stdout)
+		return
 	}
 
-	allFormatted := true
+	config := configFromFlags(cmd)
+
+	// With --git-changed or --git-staged the files come from git instead.
+	useGit := cmd.Flags().Changed("git-changed") || gitStaged
+	var lineRanges map[string][]lib.LineRange
+	if useGit {
+		args, lineRanges = gitInputs(cmd, args)
+	} else if changedLines {
+		fatalf("Error: --changed-lines requires --git-changed or --git-staged")
+	}
 
-	if len(args) == 0 {
+	var summary runSummary
+	if len(args) == 0 && !useGit {
 		if writeFlag {
-			log.Fatal("Error: Cannot use -w/--write flag when reading from stdin")
+			fatalf("Error: Cannot use -w/--write flag when reading from stdin")
 		}
 
 		inputBytes, err := io.ReadAll(os.Stdin)
 		if err != nil {
-			log.Fatalf("Failed to read from stdin: %v", err)
+			fatalf("Failed to read from stdin: %v", err)
 		}
 
 		if len(inputBytes) <= 1 {
 			cmd.Help()
-			os.Exit(0)
+			os.Exit(exitOK)
 		}
 
-		if !processInput("stdin", inputBytes, config) {
-			allFormatted = false // Mark as not formatted if check fails
+		// With --stdin-filename the input is configured and reported as if it
+		// were read from that path.
+		inputName, inputConfig := "stdin", config
+		if stdinFilename != "" {
+			inputName = stdinFilename
+			inputConfig = applyEditorConfig(config, editorConfigPath(stdinFilename), cmd)
 		}
-
+		summary.add(processInput(inputName, inputBytes, nil, inputConfig))
 	} else {
+		if stdinFilename != "" {
+			fatalf("Error: Cannot use --stdin-filename with file arguments")
+		}
+		if backupSuffix != "" && !writeFlag {
+			fatalf("Error: --backup requires -w/--write")
+		}
+		cache := openCache(cmd)
+		// Every file is processed even if an earlier one fails, so a run
+		// reports all problems at once.
 		for _, fileName := range args {
-			inputBytes, err := os.ReadFile(fileName)
+			inputBytes, readInfo, err := readFile(fileName)
 			if err != nil {
-				log.Fatalf("Failed to read file %s: %v", fileName, err)
+				summary.add(false, fmt.Errorf("Failed to read file %s: %w", fileName, err))
+				continue
+			}
+
+			fileConfig := applyEditorConfig(config, editorConfigPath(fileName), cmd)
+			if ranges, ok := lineRanges[fileName]; ok {
+				c := *fileConfig
+				c.LineRanges = ranges
+				fileConfig = &c
+			}
+
+			var key string
+			if cache != nil {
+				key = cache.key(fileName, inputBytes, fileConfig)
+				if cache.formatted(key) {
+					summary.add(skipInput(inputBytes))
+					continue
+				}
+			}
+			changed, err := processInput(fileName, inputBytes, readInfo, fileConfig)
+			// A file with problems is never skipped, so they keep being
+			// reported.
+			if cache != nil && !changed && err == nil && len(inputProblems(fileName, inputBytes)) == 0 {
+				cache.add(key)
+			}
+			summary.add(changed, err)
+		}
+		if cache != nil {
+			if err := cache.save(); err != nil {
+				log.Printf("Warning: failed to write cache %s: %v", cache.path, err)
 			}
+		}
+		summary.print(os.Stderr)
+	}
+	os.Exit(summary.exitCode())
+}
+
+// configFromFlags builds the Config set by the command-line flags, before
+// any EditorConfig settings are applied.
+func configFromFlags(cmd *cobra.Command) *lib.Config {
+	disable := disableRules
+	if keepMaintainer {
+		disable = append(slices.Clone(disable), lib.RuleMaintainerToLabel)
+	}
+	rules, err := parseRules(enableRules, disable)
+	if err != nil {
+		fatalf("Error: %v", err)
+	}
+	switch lineEnding {
+	case lib.LineEndingAuto, lib.LineEndingLF, lib.LineEndingCRLF:
+	default:
+		fatalf("Error: unknown line ending %q (want auto, lf or crlf)", lineEnding)
+	}
+
+	c := &lib.Config{
+		IndentSize:      indentSize,
+		TrailingNewline: newlineFlag,
+		SpaceRedirects:  spaceRedirects,
+		UseTabs:         useTabs,
+		LineEnding:      lineEnding,
+		StripBOM:        stripBOM,
+
+		BlankLineBeforeStage:  blankLineBeforeStage,
+		GroupDirectives:       groupDirectives,
+		TrimLeadingBlankLines: trimLeadingBlankLines,
+
+		CommentSpace:   commentSpace,
+		ReflowComments: reflowComments,
+		LineWidth:      lineWidth,
+
+		SortDockerignore: sortDockerignore,
+
+		Rules: rules,
+	}
+	// Zero is a limit of its own, so the flag only applies when given.
+	if cmd.Flags().Changed("max-blank-lines") {
+		c.MaxBlankLines = &maxBlankLines
+	}
+	return c
+}
+
+// openCache loads the cache selected by --cache and --cache-location, or
+// returns nil if caching is off.
+func openCache(cmd *cobra.Command) *formatCache {
+	if !cacheFlag {
+		if cmd.Flags().Changed("cache-location") {
+			fatalf("Error: --cache-location requires --cache")
+		}
+		return nil
+	}
+	path := cacheLocation
+	if path == "" {
+		var err error
+		if path, err = defaultCachePath(); err != nil {
+			fatalf("Error: cannot find a cache directory (use --cache-location): %v", err)
+		}
+	}
+	return loadCache(path)
+}
 
-			fileConfig := applyEditorConfig(config, fileName, cmd)
-			if !processInput(fileName, inputBytes, fileConfig) {
-				allFormatted = false
+// skipInput handles an input the cache knows is formatted: there is nothing
+// to check or write, and printing it prints it unchanged.
+func skipInput(inputBytes []byte) (changed bool, err error) {
+	if checkFlag || writeFlag {
+		return false, nil
+	}
+	if _, err := os.Stdout.Write(inputBytes); err != nil {
+		return false, fmt.Errorf("Failed to write to stdout: %w", err)
+	}
+	return false, nil
+}
+
+// gitInputs returns the Dockerfiles selected by --git-changed or --git-staged
+// and, with --changed-lines, the lines to format in each.
+func gitInputs(cmd *cobra.Command, args []string) ([]string, map[string][]lib.LineRange) {
+	if len(args) > 0 {
+		fatalf("Error: Cannot use file arguments with --git-changed or --git-staged (pass a ref as --git-changed=REF)")
+	}
+	if gitStaged && cmd.Flags().Changed("git-changed") {
+		fatalf("Error: Cannot use --git-changed with --git-staged")
+	}
+	if gitChanged == "" {
+		gitChanged = "HEAD"
+	}
+	changes, err := gitChangedDockerfiles(gitChanged, gitStaged)
+	if err != nil {
+		fatalf("Error: %v", err)
+	}
+
+	var files []string
+	lineRanges := map[string][]lib.LineRange{}
+	for _, change := range changes {
+		// The working tree is what gets formatted, so formatting a file whose
+		// staged version differs from it would format and re-stage the wrong
+		// contents.
+		if gitStaged {
+			unstaged, err := gitHasUnstagedChanges(change.path)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+			if unstaged {
+				fatalf("Error: %s has unstaged changes; stage or stash them before using --git-staged", change.path)
 			}
 		}
+		if changedLines && !change.untracked {
+			ranges, err := gitChangedLines(change.path, gitChanged, gitStaged)
+			if err != nil {
+				fatalf("Error: %v", err)
+			}
+			if len(ranges) == 0 {
+				// Only the file's name or mode changed.
+				continue
+			}
+			lineRanges[change.path] = ranges
+		}
+		files = append(files, change.path)
+	}
+	return files, lineRanges
+}
+
+// Exit codes of the root command.
+const (
+	exitOK = 0
+	// exitUnformatted means --check found files that need formatting.
+	exitUnformatted = 1
+	// exitError means a file couldn't be read, parsed, verified or written,
+	// or the command line was invalid.
+	exitError = 2
+)
+
+// fatalf reports an error that stops the whole run.
+func fatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(exitError)
+}
+
+// runSummary counts the outcomes of the files processed by a run.
+type runSummary struct {
+	files   int
+	changed int
+	errors  int
+}
+
+// add records the result of processInput, printing its error if any.
+func (s *runSummary) add(changed bool, err error) {
+	s.files++
+	if err != nil {
+		log.Print(err)
+		s.errors++
+	}
+	if changed {
+		s.changed++
+	}
+}
+
+// print writes a line with the counts. Nothing is printed when formatting to
+// stdout without errors, so the output can be piped.
+func (s *runSummary) print(w io.Writer) {
+	var changed string
+	switch {
+	case checkFlag:
+		changed = fmt.Sprintf("%d not formatted", s.changed)
+	case writeFlag:
+		changed = fmt.Sprintf("%d reformatted", s.changed)
+	case s.errors == 0:
+		return
+	default:
+		changed = fmt.Sprintf("%d formatted", s.files-s.errors)
+	}
+	fmt.Fprintf(w, "%s: %s, %s\n", plural(s.files, "file"), changed, plural(s.errors, "error"))
+}
+
+func (s *runSummary) exitCode() int {
+	switch {
+	case s.errors > 0:
+		return exitError
+	case checkFlag && s.changed > 0:
+		return exitUnformatted
 	}
+	return exitOK
+}
 
-	// If check mode was enabled and any input was not formatted, exit with status 1
-	if checkFlag && !allFormatted {
-		os.Exit(1)
+func plural(n int, noun string) string {
+	if n != 1 {
+		noun += "s"
 	}
+	return fmt.Sprintf("%d %s", n, noun)
 }
 
 // applyEditorConfig returns a Config with editorconfig properties applied for
@@ -95,6 +362,30 @@ func applyEditorConfig(base *lib.Config, filePath string, cmd *cobra.Command) *l
 		}
 	}
 
+	// indent_style — only apply if the CLI flag was not explicitly set.
+	if !cmd.Flags().Changed("use-tabs") && def.IndentStyle != "" {
+		c.UseTabs = def.IndentStyle == editorconfig.IndentStyleTab
+	}
+
+	// end_of_line — only apply if the CLI flag was not explicitly set. "cr"
+	// line endings aren't supported.
+	if !cmd.Flags().Changed("line-ending") {
+		switch def.EndOfLine {
+		case editorconfig.EndOfLineLf, editorconfig.EndOfLineCrLf:
+			c.LineEnding = def.EndOfLine
+		}
+	}
+
+	// charset — "utf-8-bom" keeps a byte order mark, "utf-8" strips it.
+	if !cmd.Flags().Changed("strip-bom") {
+		switch def.Charset {
+		case editorconfig.CharsetUTF8:
+			c.StripBOM = true
+		case editorconfig.CharsetUTF8BOM:
+			c.StripBOM = false
+		}
+	}
+
 	// insert_final_newline — only apply if the CLI flag was not explicitly set.
 	if !cmd.Flags().Changed("newline") && def.InsertFinalNewline != nil {
 		c.TrailingNewline = *def.InsertFinalNewline
@@ -109,48 +400,261 @@ func applyEditorConfig(base *lib.Config, filePath string, cmd *cobra.Command) *l
 		}
 	}
 
+	// Blank-line policy — dockerfmt-specific properties.
+	if !cmd.Flags().Changed("max-blank-lines") {
+		if v, ok := def.Raw["max_blank_lines"]; ok {
+			if n, err := strconv.ParseUint(v, 10, 0); err == nil {
+				limit := uint(n)
+				c.MaxBlankLines = &limit
+			}
+		}
+	}
+	if !cmd.Flags().Changed("blank-line-before-stage") {
+		if v, ok := def.Raw["blank_line_before_stage"]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				c.BlankLineBeforeStage = b
+			}
+		}
+	}
+	if !cmd.Flags().Changed("group-directives") {
+		if v, ok := def.Raw["group_directives"]; ok {
+			c.GroupDirectives = strings.Split(v, ",")
+		}
+	}
+	if !cmd.Flags().Changed("trim-leading-blank-lines") {
+		if v, ok := def.Raw["trim_leading_blank_lines"]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				c.TrimLeadingBlankLines = b
+			}
+		}
+	}
+
+	// enable_rules / disable_rules — dockerfmt-specific properties. Rules named
+	// on the command line take precedence; unknown rule names are ignored. As
+	// on the command line, disable_rules wins for a rule in both.
+	c.Rules = maps.Clone(base.Rules)
+	if c.Rules == nil {
+		c.Rules = map[string]bool{}
+	}
+	for _, prop := range []struct {
+		key string
+		on  bool
+	}{{"enable_rules", true}, {"disable_rules", false}} {
+		v, ok := def.Raw[prop.key]
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if _, known := lib.LookupRule(name); !known {
+				continue
+			}
+			if _, set := base.Rules[name]; !set {
+				c.Rules[name] = prop.on
+			}
+		}
+	}
+	// keep_maintainer — deprecated alias for disabling maintainer-to-label.
+	if v, ok := def.Raw["keep_maintainer"]; ok {
+		if b, err := strconv.ParseBool(v); err == nil && b {
+			if _, set := base.Rules[lib.RuleMaintainerToLabel]; !set {
+				c.Rules[lib.RuleMaintainerToLabel] = false
+			}
+		}
+	}
+
+	// max_line_length — only apply if the CLI flag was not explicitly set.
+	if !cmd.Flags().Changed("line-width") {
+		if v, ok := def.Raw["max_line_length"]; ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				c.LineWidth = uint(n)
+			}
+		}
+	}
+
+	// Comment normalization — dockerfmt-specific properties.
+	if !cmd.Flags().Changed("comment-space") {
+		if v, ok := def.Raw["comment_space"]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				c.CommentSpace = b
+			}
+		}
+	}
+	if !cmd.Flags().Changed("reflow-comments") {
+		if v, ok := def.Raw["reflow_comments"]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				c.ReflowComments = b
+			}
+		}
+	}
+
+	// sort_dockerignore — dockerfmt-specific property.
+	if !cmd.Flags().Changed("sort-dockerignore") {
+		if v, ok := def.Raw["sort_dockerignore"]; ok {
+			if b, err := strconv.ParseBool(v); err == nil {
+				c.SortDockerignore = b
+			}
+		}
+	}
+
 	return &c
 }
 
-func processInput(inputName string, inputBytes []byte, config *lib.Config) (formatted bool) {
+// parseRules builds Config.Rules from the --enable-rules and --disable-rules flags.
+func parseRules(enable, disable []string) (map[string]bool, error) {
+	rules := map[string]bool{}
+	for _, names := range []struct {
+		list []string
+		on   bool
+	}{{enable, true}, {disable, false}} {
+		for _, name := range names.list {
+			if _, ok := lib.LookupRule(name); !ok {
+				return nil, fmt.Errorf("unknown rule %q (see --list-rules)", name)
+			}
+			rules[name] = names.on
+		}
+	}
+	return rules, nil
+}
+
+// printRules writes every rule with its default and description.
+func printRules(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tDEFAULT\tDESCRIPTION")
+	for _, r := range lib.Rules {
+		state := "off"
+		if r.Default {
+			state = "on"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, state, r.Description)
+	}
+	tw.Flush()
+}
+
+// processInput formats one input and checks, writes or prints it. It reports
+// whether formatting changed the input. readInfo is the state of the file when
+// it was read, or nil for stdin (see writeFileAtomic).
+func processInput(inputName string, inputBytes []byte, readInfo os.FileInfo, config *lib.Config) (changed bool, err error) {
 	originalContent := string(inputBytes)
-	lines := strings.SplitAfter(strings.TrimSuffix(originalContent, "\n"), "\n")
 
-	formattedContent := lib.FormatFileLines(lines, config)
+	formatter := lib.NewFormatter(config)
+	var formattedBytes []byte
+	var blockErrs []error
+	problems := 0
+	if isDockerignore(inputName) {
+		formattedBytes = formatter.FormatDockerignore(inputBytes)
+		problems = reportProblems(inputName, inputProblems(inputName, inputBytes))
+	} else if formatEmbedded := embeddedFormat(formatter, inputName); formatEmbedded != nil {
+		var blocks []lib.EmbeddedDockerfile
+		formattedBytes, blocks, err = formatEmbedded(inputBytes)
+		if err != nil {
+			return false, fmt.Errorf("Failed to parse %s: %w", inputName, err)
+		}
+		// Dockerfiles that can't be formatted are reported once the rest of
+		// the file has been checked or written.
+		for _, b := range blocks {
+			switch {
+			case b.Err != nil:
+				blockErrs = append(blockErrs, fmt.Errorf("Failed to format %s:%d: %w", inputName, b.ErrorLine(), b.Err))
+			case b.Changed && checkFlag:
+				fmt.Printf("%s:%d: Dockerfile is not formatted\n", inputName, b.Line)
+			case b.Skipped && checkFlag:
+				fmt.Printf("%s:%d: Dockerfile skipped, only literal block scalars (|) are formatted\n", inputName, b.Line)
+			case b.Skipped:
+				log.Printf("Warning: %s:%d: Dockerfile skipped, only literal block scalars (|) are formatted", inputName, b.Line)
+			}
+		}
+		if verifyFlag {
+			for _, b := range blocks {
+				if err := formatter.VerifyEmbedded(b); err != nil {
+					return false, fmt.Errorf("Failed to verify %s:%d: %w", inputName, b.Line, err)
+				}
+			}
+		}
+	} else {
+		formattedBytes, err = formatter.FormatBytes(inputBytes)
+		if err != nil {
+			return false, fmt.Errorf("Failed to format %s: %w", inputName, err)
+		}
+		if verifyFlag {
+			if err := formatter.Verify(originalContent, string(formattedBytes)); err != nil {
+				return false, fmt.Errorf("Failed to verify %s: %w", inputName, err)
+			}
+		}
+		problems = reportProblems(inputName, inputProblems(inputName, inputBytes))
+	}
+	formattedContent := string(formattedBytes)
 
+	changed = originalContent != formattedContent
 	if checkFlag {
-		if originalContent != formattedContent {
+		// Embedded Dockerfiles were reported with their lines above.
+		if changed && embeddedKind(inputName) == "" {
 			fmt.Printf("%s is not formatted\n", inputName)
-			return false
 		}
-		return true
+		// Problems such as invalid mounts fail the check too.
+		changed = changed || problems > 0
 	} else if writeFlag {
-		if originalContent != formattedContent {
-			err := os.WriteFile(inputName, []byte(formattedContent), 0644)
+		if changed {
+			err := writeFileAtomic(inputName, formattedBytes, inputBytes, readInfo, backupSuffix)
 			if err != nil {
-				log.Fatalf("Failed to write to file %s: %v", inputName, err)
+				return false, fmt.Errorf("Failed to write to file %s: %w", inputName, err)
 			}
 		}
 	} else {
 		_, err := os.Stdout.Write([]byte(formattedContent))
 		if err != nil {
-			log.Fatalf("Failed to write to stdout: %v", err)
+			return false, fmt.Errorf("Failed to write to stdout: %w", err)
 		}
 	}
-	return true
+	return changed, errors.Join(blockErrs...)
 }
 
 func init() {
 	rootCmd.Flags().BoolVarP(&writeFlag, "write", "w", false, "Write the formatted output back to the file(s)")
+	rootCmd.Flags().StringVar(&backupSuffix, "backup", "", "With --write, save the original of each changed file with this suffix (e.g. .orig)")
+	rootCmd.Flags().StringVar(&gitChanged, "git-changed", "", "Format the Dockerfiles changed since a git ref, and untracked ones")
+	rootCmd.Flags().Lookup("git-changed").NoOptDefVal = "HEAD"
+	rootCmd.Flags().BoolVar(&gitStaged, "git-staged", false, "Format the Dockerfiles with changes staged in the git index")
+	rootCmd.Flags().BoolVar(&changedLines, "changed-lines", false, "With --git-changed or --git-staged, only format the directives that overlap changed lines")
+	rootCmd.Flags().BoolVar(&cacheFlag, "cache", false, "Skip files that a previous run found formatted with the same settings")
+	rootCmd.Flags().StringVar(&cacheLocation, "cache-location", "", "Path of the cache file (default: dockerfmt/cache.json in the user cache directory)")
 	rootCmd.Flags().BoolVarP(&checkFlag, "check", "c", false, "Check if the file(s) are formatted")
+	rootCmd.Flags().StringVar(&stdinFilename, "stdin-filename", "", "Path used to resolve EditorConfig settings and name the input when reading from stdin")
+	rootCmd.Flags().BoolVar(&verifyFlag, "verify", false, "Check that formatting doesn't change the build and is idempotent before writing")
 	rootCmd.Flags().BoolVarP(&newlineFlag, "newline", "n", false, "End the file with a trailing newline")
 	rootCmd.Flags().UintVarP(&indentSize, "indent", "i", 4, "Number of spaces to use for indentation")
+	rootCmd.Flags().BoolVarP(&useTabs, "use-tabs", "t", false, "Indent with tabs instead of spaces")
+	rootCmd.Flags().StringVar(&lineEnding, "line-ending", lib.LineEndingAuto, "Line ending of the output: auto (keep the input's), lf or crlf")
+	rootCmd.Flags().BoolVar(&stripBOM, "strip-bom", false, "Remove a UTF-8 byte order mark")
 	rootCmd.Flags().BoolVarP(&spaceRedirects, "space-redirects", "s", false, "Redirect operators will be followed by a space")
+	rootCmd.Flags().UintVar(&maxBlankLines, "max-blank-lines", 0, "Maximum number of consecutive blank lines (by default, runs of three or more collapse to one)")
+	rootCmd.Flags().BoolVar(&blankLineBeforeStage, "blank-line-before-stage", false, "Require a blank line before every FROM after the first")
+	rootCmd.Flags().StringSliceVar(&groupDirectives, "group-directives", nil, "Directives (e.g. ENV,ARG,LABEL) with no blank lines between consecutive occurrences")
+	rootCmd.Flags().StringSliceVar(&enableRules, "enable-rules", nil, "Rules to enable (see --list-rules)")
+	rootCmd.Flags().StringSliceVar(&disableRules, "disable-rules", nil, "Rules to disable (see --list-rules)")
+	rootCmd.Flags().BoolVar(&listRules, "list-rules", false, "List the formatting rules with their defaults and exit")
+	rootCmd.Flags().BoolVar(&keepMaintainer, "keep-maintainer", false, "Keep MAINTAINER instead of upgrading it to a LABEL")
+	rootCmd.Flags().MarkDeprecated("keep-maintainer", "use --disable-rules=maintainer-to-label instead")
+	rootCmd.Flags().BoolVar(&commentSpace, "comment-space", false, "Ensure a space after # in comments")
+	rootCmd.Flags().BoolVar(&reflowComments, "reflow-comments", false, "Reflow comment paragraphs longer than the line width")
+	rootCmd.Flags().UintVar(&lineWidth, "line-width", 80, "Maximum line width used when reflowing comments")
+	rootCmd.Flags().BoolVar(&sortDockerignore, "sort-dockerignore", false, "Sort neighbouring patterns in .dockerignore files")
+	rootCmd.Flags().BoolVar(&trimLeadingBlankLines, "trim-leading-blank-lines", false, "Remove blank lines at the start of the file, after parser directives")
+
+	// The watch command formats with the same settings.
+	for _, name := range []string{
+		"check", "verify", "backup", "newline", "indent", "use-tabs", "line-ending", "strip-bom",
+		"space-redirects", "max-blank-lines", "blank-line-before-stage", "group-directives",
+		"enable-rules", "disable-rules", "keep-maintainer", "comment-space", "reflow-comments", "line-width",
+		"trim-leading-blank-lines", "sort-dockerignore",
+	} {
+		watchCmd.Flags().AddFlag(rootCmd.Flags().Lookup(name))
+	}
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 }
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// runDockerfmt runs the test binary as dockerfmt itself, since the
+	// command exits the process.
+	if os.Getenv("DOCKERFMT_TEST_RUN") == "1" {
+		Execute()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// runDockerfmt runs dockerfmt with args in dir, reading stdin, and returns
+// what it printed and its exit status.
+func runDockerfmt(t *testing.T, dir, stdin string, args ...string) (stdout, stderr string, status int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "DOCKERFMT_TEST_RUN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status = exitErr.ExitCode()
+	} else {
+		require.NoError(t, err)
+	}
+	return out.String(), errOut.String(), status
+}
+
+func TestApplyEditorConfigRules(t *testing.T) {
+	dir := t.TempDir()
+	editorConfig := "root = true\n\n[Dockerfile]\nenable_rules = json-spacing,env-key-value\ndisable_rules = json-spacing\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".editorconfig"), []byte(editorConfig), 0o644))
+	path := filepath.Join(dir, "Dockerfile")
+
+	// Map order once decided which property won; check it more than once.
+	for range 20 {
+		c := applyEditorConfig(&lib.Config{}, path, rootCmd)
+		assert.Equal(t, map[string]bool{lib.RuleJSONSpacing: false, lib.RuleEnvKeyValue: true}, c.Rules)
+	}
+
+	// Rules given on the command line take precedence.
+	c := applyEditorConfig(&lib.Config{Rules: map[string]bool{lib.RuleJSONSpacing: true}}, path, rootCmd)
+	assert.True(t, c.Enabled(lib.RuleJSONSpacing))
+}
+
+func TestApplyEditorConfigKeepMaintainer(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".editorconfig"), []byte("root = true\n\n[*]\nkeep_maintainer = true\n"), 0o644))
+	path := filepath.Join(dir, "Dockerfile")
+
+	assert.False(t, applyEditorConfig(&lib.Config{}, path, rootCmd).Enabled(lib.RuleMaintainerToLabel))
+
+	base := &lib.Config{Rules: map[string]bool{lib.RuleMaintainerToLabel: true}}
+	assert.True(t, applyEditorConfig(base, path, rootCmd).Enabled(lib.RuleMaintainerToLabel))
+}
+
+func TestInvalidMount(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM a\nRUN --mount=type=cache,bogus=1 ls\n"), 0o644))
+
+	_, stderr, status := runDockerfmt(t, dir, "", "-w", "-n", "Dockerfile")
+	assert.Equal(t, exitOK, status)
+	assert.Contains(t, stderr, `Warning: Dockerfile:2: Invalid mount "--mount=type=cache,bogus=1"`)
+
+	// The mount fails the check of a file that is otherwise formatted.
+	stdout, _, status := runDockerfmt(t, dir, "", "-c", "-n", "Dockerfile")
+	assert.Equal(t, exitUnformatted, status)
+	assert.Equal(t, "Dockerfile:2: Invalid mount \"--mount=type=cache,bogus=1\": unexpected key 'bogus' in 'bogus=1' (InvalidMount)\n", stdout)
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "formatted.dockerfile"), "FROM a\n")
+	writeFile(t, filepath.Join(dir, "unformatted.dockerfile"), "from a\n")
+	writeFile(t, filepath.Join(dir, "unparseable.dockerfile"), "FROM a\nRUN <<EOF\n")
+
+	stdout, stderr, status := runDockerfmt(t, dir, "", "-c", "-n", "formatted.dockerfile")
+	assert.Equal(t, exitOK, status)
+	assert.Empty(t, stdout)
+	assert.Equal(t, "1 file: 0 not formatted, 0 errors\n", stderr)
+
+	stdout, stderr, status = runDockerfmt(t, dir, "", "-c", "-n", "formatted.dockerfile", "unformatted.dockerfile")
+	assert.Equal(t, exitUnformatted, status)
+	assert.Equal(t, "unformatted.dockerfile is not formatted\n", stdout)
+	assert.Equal(t, "2 files: 1 not formatted, 0 errors\n", stderr)
+
+	// The files after one that fails are still checked, and errors win over
+	// unformatted files.
+	stdout, stderr, status = runDockerfmt(t, dir, "", "-c", "-n", "unparseable.dockerfile", "missing.dockerfile", "unformatted.dockerfile", "formatted.dockerfile")
+	assert.Equal(t, exitError, status)
+	assert.Equal(t, "unformatted.dockerfile is not formatted\n", stdout)
+	assert.Contains(t, stderr, "Failed to format unparseable.dockerfile: unterminated heredoc\n")
+	assert.Contains(t, stderr, "Failed to read file missing.dockerfile: ")
+	assert.True(t, strings.HasSuffix(stderr, "\n4 files: 1 not formatted, 2 errors\n"), stderr)
+
+	_, stderr, status = runDockerfmt(t, dir, "", "-w", "-n", "unparseable.dockerfile", "missing.dockerfile", "unformatted.dockerfile")
+	assert.Equal(t, exitError, status)
+	assert.True(t, strings.HasSuffix(stderr, "\n3 files: 1 reformatted, 2 errors\n"), stderr)
+	data, err := os.ReadFile(filepath.Join(dir, "unformatted.dockerfile"))
+	require.NoError(t, err)
+	assert.Equal(t, "FROM a\n", string(data))
+}
+
+func TestStdinFilename(t *testing.T) {
+	// The settings come from the directory of --stdin-filename, not the
+	// working directory.
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app", ".editorconfig"), "[Dockerfile]\nindent_size = 2\n")
+	name := filepath.Join(dir, "app", "Dockerfile")
+
+	stdout, _, status := runDockerfmt(t, dir, "FROM a\nRUN a \\\n && b\n", "-n", "--stdin-filename", name)
+	assert.Equal(t, exitOK, status)
+	assert.Equal(t, "FROM a\nRUN a \\\n  && b\n", stdout)
+
+	stdout, _, status = runDockerfmt(t, dir, "from a\n", "-c", "--stdin-filename", name)
+	assert.Equal(t, exitUnformatted, status)
+	assert.Equal(t, name+" is not formatted\n", stdout)
+
+	_, stderr, status := runDockerfmt(t, dir, "FROM a\nRUN <<EOF\n", "--stdin-filename", name)
+	assert.Equal(t, exitError, status)
+	assert.Contains(t, stderr, "Failed to format "+name+": unterminated heredoc\n")
+}
+
+func TestComposeSkipped(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "compose.yaml"), "services:\n  app:\n    build:\n      dockerfile_inline: \"from alpine\"\n")
+
+	stdout, _, status := runDockerfmt(t, dir, "", "-c", "compose.yaml")
+	assert.Equal(t, exitOK, status)
+	assert.Equal(t, "compose.yaml:4: Dockerfile skipped, only literal block scalars (|) are formatted\n", stdout)
+
+	_, stderr, status := runDockerfmt(t, dir, "", "-w", "compose.yaml")
+	assert.Equal(t, exitOK, status)
+	assert.Contains(t, stderr, "Warning: compose.yaml:4: Dockerfile skipped, only literal block scalars (|) are formatted\n")
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchInterval time.Duration
+	watchDebounce time.Duration
+)
+
+func init() {
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 500*time.Millisecond, "How often to look for changed files")
+	watchCmd.Flags().DurationVar(&watchDebounce, "debounce", 300*time.Millisecond, "How long a changed file must stay unchanged before it is formatted")
+	rootCmd.AddCommand(watchCmd)
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [path...]",
+	Short: "Format Dockerfiles whenever they change",
+	Long:  `Watch Dockerfiles and .dockerignore files and format them whenever they change, or with --check only report the ones that aren't formatted. Directories (the current one by default) are searched for files named like Dockerfiles; files given by name are watched whatever they are called. Runs until interrupted.`,
+	Run:   runWatch,
+}
+
+// rescanInterval is how often the watched directories are searched again
+// even if none of their modification times changed, for file systems that
+// don't update them reliably.
+const rescanInterval = 30 * time.Second
+
+// watchedFile is the last seen state of a watched file.
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+	// changedAt is when a change was last seen, if the file is waiting to
+	// be formatted.
+	changedAt time.Time
+}
+
+// watcher polls the files under a set of paths for changes. Searching the
+// directories is only repeated when one of their modification times changes,
+// which happens when an entry is added, removed or renamed, or every
+// rescanInterval; otherwise only the files already found are checked.
+type watcher struct {
+	paths []string
+	files map[string]*watchedFile
+	// dirs holds the modification time of each directory searched, and of
+	// the directory of each file given by name.
+	dirs     map[string]time.Time
+	lastScan time.Time
+}
+
+// newWatcher returns a watcher for paths. The files that already exist are
+// only formatted once they change.
+func newWatcher(paths []string, now time.Time) *watcher {
+	w := &watcher{paths: paths, files: map[string]*watchedFile{}, lastScan: now}
+	var found map[string]os.FileInfo
+	found, w.dirs = watchFiles(paths)
+	for path, info := range found {
+		w.files[path] = &watchedFile{modTime: info.ModTime(), size: info.Size()}
+	}
+	return w
+}
+
+// poll looks for files that were added, changed or removed since the last
+// poll, and marks the ones that changed with the time now.
+func (w *watcher) poll(now time.Time) {
+	var found map[string]os.FileInfo
+	if w.dirsChanged() || now.Sub(w.lastScan) >= rescanInterval {
+		found, w.dirs = watchFiles(w.paths)
+		w.lastScan = now
+	} else {
+		found = map[string]os.FileInfo{}
+		for path := range w.files {
+			if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+				found[path] = info
+			}
+		}
+	}
+
+	for path := range w.files {
+		if _, ok := found[path]; !ok {
+			delete(w.files, path)
+		}
+	}
+	for path, info := range found {
+		f, ok := w.files[path]
+		if !ok {
+			f = &watchedFile{}
+			w.files[path] = f
+		}
+		if !ok || !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+			f.modTime, f.size, f.changedAt = info.ModTime(), info.Size(), now
+		}
+	}
+}
+
+// dirsChanged reports whether any watched directory was modified or removed.
+func (w *watcher) dirsChanged() bool {
+	for dir, modTime := range w.dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// settled returns the changed files that haven't changed again for
+// watchDebounce, clearing their change.
+func (w *watcher) settled(now time.Time) []string {
+	var paths []string
+	for path, f := range w.files {
+		if f.changedAt.IsZero() || now.Sub(f.changedAt) < watchDebounce {
+			continue
+		}
+		f.changedAt = time.Time{}
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// seen records info as the state of path that was handled, so that only
+// later changes count.
+func (w *watcher) seen(path string, info os.FileInfo) {
+	if f, ok := w.files[path]; ok {
+		f.modTime, f.size = info.ModTime(), info.Size()
+	}
+}
+
+func runWatch(cmd *cobra.Command, args []string) {
+	config := configFromFlags(cmd)
+	if backupSuffix != "" && checkFlag {
+		fatalf("Error: Cannot use --backup with --check")
+	}
+	if watchInterval <= 0 {
+		fatalf("Error: --interval must be positive")
+	}
+	// Without --check, changed files are written back.
+	writeFlag = !checkFlag
+
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	for _, path := range args {
+		if _, err := os.Stat(path); err != nil {
+			fatalf("Error: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	w := newWatcher(args, time.Now())
+	log.Printf("Watching %s", plural(len(w.files), "file"))
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		w.poll(now)
+		// Editors often save in several writes; wait for a file to settle.
+		for _, path := range w.settled(now) {
+			if info := watchProcess(cmd, path, config); info != nil {
+				w.seen(path, info)
+			}
+		}
+	}
+}
+
+// watchFiles returns the files to watch under paths: each file given by name,
+// and the Dockerfiles and .dockerignore files in each directory, skipping
+// hidden directories. It also returns the modification times of the
+// directories it searched and of the directories of the files given by name.
+func watchFiles(paths []string) (map[string]os.FileInfo, map[string]time.Time) {
+	files := map[string]os.FileInfo{}
+	dirs := map[string]time.Time{}
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			if err == nil {
+				files[root] = info
+			}
+			// A file given by name that is removed and created again shows
+			// up as a change to its directory.
+			if dir, err := os.Stat(filepath.Dir(root)); err == nil {
+				dirs[filepath.Dir(root)] = dir.ModTime()
+			}
+			continue
+		}
+		// Files that vanish during the walk are simply not watched.
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				if info, err := d.Info(); err == nil {
+					dirs[path] = info.ModTime()
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || !isDockerfile(path) && !isDockerignore(path) {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				files[path] = info
+			}
+			return nil
+		})
+	}
+	return files, dirs
+}
+
+// watchProcess formats or checks a file that changed, then prints buildkit's
+// warnings for it. It returns the state of the file it handled, or nil if the
+// file couldn't be read. A file that changed again before it could be written
+// back is left as it is, and the state it was read in is returned so that the
+// new change is seen.
+func watchProcess(cmd *cobra.Command, path string, config *lib.Config) os.FileInfo {
+	inputBytes, info, err := readFile(path)
+	if err != nil {
+		log.Printf("Failed to read file %s: %v", path, err)
+		return nil
+	}
+	fileConfig := applyEditorConfig(config, editorConfigPath(path), cmd)
+	changed, err := processInput(path, inputBytes, info, fileConfig)
+	switch {
+	case errors.Is(err, errChangedSinceRead):
+		return info
+	case err != nil:
+		log.Print(err)
+		return info
+	case changed && writeFlag:
+		log.Printf("Formatted %s", path)
+		// Don't count our own write as a change.
+		if inputBytes, info, err = readFile(path); err != nil {
+			return nil
+		}
+	case !changed:
+		log.Printf("%s is formatted", path)
+	}
+
+	if embeddedKind(path) != "" || isDockerignore(path) {
+		return info
+	}
+	// A file that doesn't parse was reported above.
+	diagnostics, _ := lib.Lint(inputBytes)
+	for _, d := range diagnostics {
+		// processInput already reported the invalid mounts.
+		if d.Rule == "InvalidMount" {
+			continue
+		}
+		msg := d.Message
+		if d.Rule != "" {
+			msg += " (" + d.Rule + ")"
+		}
+		if d.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", path, d.Line, msg)
+		} else {
+			fmt.Printf("%s: %s\n", path, msg)
+		}
+	}
+	return info
+}
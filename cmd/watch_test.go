@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/reteps/dockerfmt/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"Dockerfile", "app/api.dockerfile", "app/.dockerignore", ".git/Dockerfile", "README.md", "named.txt"} {
+		writeFile(t, filepath.Join(dir, name), "FROM a\n")
+	}
+	named := filepath.Join(dir, "named.txt")
+
+	files, dirs := watchFiles([]string{filepath.Join(dir, "app"), named, filepath.Join(dir, "missing")})
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "app", "api.dockerfile"),
+		filepath.Join(dir, "app", ".dockerignore"),
+		named,
+	}, slices.Collect(maps.Keys(files)))
+	assert.ElementsMatch(t, []string{dir, filepath.Join(dir, "app")}, slices.Collect(maps.Keys(dirs)))
+
+	files, dirs = watchFiles([]string{dir})
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "Dockerfile"),
+		filepath.Join(dir, "app", "api.dockerfile"),
+		filepath.Join(dir, "app", ".dockerignore"),
+	}, slices.Collect(maps.Keys(files)))
+	assert.ElementsMatch(t, []string{dir, filepath.Join(dir, "app")}, slices.Collect(maps.Keys(dirs)))
+}
+
+func TestWatcherPoll(t *testing.T) {
+	dir := t.TempDir()
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	writeFile(t, dockerfile, "FROM a\n")
+	writeFile(t, filepath.Join(dir, "app", "README.md"), "")
+	start := time.Now()
+	w := newWatcher([]string{dir}, start)
+	assert.Equal(t, []string{dockerfile}, slices.Collect(maps.Keys(w.files)))
+
+	// Files that exist at the start aren't formatted until they change.
+	now := start.Add(time.Second)
+	w.poll(now)
+	assert.Empty(t, w.settled(now))
+
+	// A change to a known file is seen without searching the directories.
+	writeFile(t, dockerfile, "from a\n\n")
+	added := filepath.Join(dir, "app", "Dockerfile")
+	addUnnoticed(t, added)
+	w.poll(now)
+	assert.NotContains(t, w.files, added)
+	assert.Empty(t, w.settled(now), "still changing")
+	now = now.Add(watchDebounce)
+	assert.Equal(t, []string{dockerfile}, w.settled(now))
+	assert.Empty(t, w.settled(now))
+
+	// The directories are still searched every rescanInterval.
+	now = start.Add(rescanInterval)
+	w.poll(now)
+	assert.Contains(t, w.files, added)
+
+	// Removing a file changes its directory.
+	require.NoError(t, os.Remove(dockerfile))
+	w.poll(now)
+	assert.NotContains(t, w.files, dockerfile)
+	created := filepath.Join(dir, "app", "api.dockerfile")
+	writeFile(t, created, "FROM a\n")
+	w.poll(now)
+	now = now.Add(watchDebounce)
+	assert.Equal(t, []string{added, created}, w.settled(now))
+}
+
+// addUnnoticed creates the file at path without changing its directory's
+// modification time, so that only searching the directory finds it.
+func addUnnoticed(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(filepath.Dir(path))
+	require.NoError(t, err)
+	writeFile(t, path, "FROM a\n")
+	require.NoError(t, os.Chtimes(filepath.Dir(path), info.ModTime(), info.ModTime()))
+}
+
+func TestWatchProcess(t *testing.T) {
+	saved := writeFlag
+	writeFlag = true
+	t.Cleanup(func() { writeFlag = saved })
+	config := &lib.Config{IndentSize: 4, TrailingNewline: true}
+
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	writeFile(t, path, "from a\n")
+	info := watchProcess(watchCmd, path, config)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "FROM a\n", string(data))
+	// The formatted file is what was handled, so the write isn't a change.
+	require.NotNil(t, info)
+	current, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, current.ModTime(), info.ModTime())
+	assert.Equal(t, current.Size(), info.Size())
+
+	// A file edited again while it was being formatted isn't written.
+	writeFile(t, path, "from a\n")
+	original, readInfo, err := readFile(path)
+	require.NoError(t, err)
+	writeFile(t, path, "from a\nrun b\n")
+	_, err = processInput(path, original, readInfo, config)
+	assert.ErrorIs(t, err, errChangedSinceRead)
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "from a\nrun b\n", string(data))
+}
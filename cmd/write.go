@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileModeBits are the mode bits a rewritten file keeps.
+const fileModeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// errChangedSinceRead is returned when a file changed between being read and
+// being written back.
+var errChangedSinceRead = errors.New("changed since it was read")
+
+// readFile returns the contents of the file at path and its state from
+// before they were read, to pass to writeFileAtomic.
+func readFile(path string) ([]byte, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, info, nil
+}
+
+// writeFileAtomic replaces the contents of the file at path with data. The
+// data is written to a temporary file in the same directory, which is renamed
+// over the original, so an interrupted write never leaves a truncated file.
+// The original's mode, including the setuid, setgid and sticky bits, and
+// where possible its ownership are kept, and a symlink is written through to
+// its target rather than replaced. If backupSuffix is set, the original
+// contents are first saved next to the file with that suffix.
+//
+// If readInfo is set, the file is only replaced if its modification time and
+// size still match, so an edit made after original was read isn't lost.
+func writeFileAtomic(path string, data, original []byte, readInfo os.FileInfo, backupSuffix string) error {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if readInfo != nil && (!info.ModTime().Equal(readInfo.ModTime()) || info.Size() != readInfo.Size()) {
+		return fmt.Errorf("%s %w", path, errChangedSinceRead)
+	}
+	// Renaming would get around the permissions of a read-only file, so check
+	// that it could be written in place. Opening it doesn't change it.
+	f, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%s is read-only", path)
+	} else if err != nil {
+		return err
+	}
+	f.Close()
+
+	if backupSuffix != "" {
+		if err := writeTemp(target+backupSuffix, original, info); err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+	}
+	return writeTemp(target, data, info)
+}
+
+// writeTemp writes data to a temporary file next to path with the mode and
+// ownership of info, then renames it to path.
+func writeTemp(path string, data []byte, info os.FileInfo) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	// Only root can give a file away, so a failed chown leaves the file owned
+	// by the current user. Changing the owner clears the setuid and setgid
+	// bits, so the mode is set after.
+	chown(f, info)
+	if err := f.Chmod(info.Mode() & fileModeBits); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
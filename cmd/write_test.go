@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	require.NoError(t, os.WriteFile(path, []byte("from a\n"), 0o644))
+
+	require.NoError(t, writeFileAtomic(path, []byte("FROM a\n"), []byte("from a\n"), nil, ".orig"))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "FROM a\n", string(data))
+	backup, err := os.ReadFile(path + ".orig")
+	require.NoError(t, err)
+	assert.Equal(t, "from a\n", string(backup))
+
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestWriteFileAtomicKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix file modes")
+	}
+	for _, mode := range []fs.FileMode{0o600, 0o755, 0o644 | fs.ModeSetuid | fs.ModeSetgid, 0o755 | fs.ModeSticky} {
+		t.Run(mode.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "Dockerfile")
+			require.NoError(t, os.WriteFile(path, []byte("from a\n"), 0o600))
+			require.NoError(t, os.Chmod(path, mode))
+
+			require.NoError(t, writeFileAtomic(path, []byte("FROM a\n"), nil, nil, ""))
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Equal(t, mode, info.Mode()&fileModeBits)
+		})
+	}
+}
+
+func TestWriteFileAtomicThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "Dockerfile.real")
+	link := filepath.Join(dir, "Dockerfile")
+	require.NoError(t, os.WriteFile(target, []byte("from a\n"), 0o644))
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+
+	require.NoError(t, writeFileAtomic(link, []byte("FROM a\n"), nil, nil, ""))
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+	data, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "FROM a\n", string(data))
+}
+
+func TestWriteFileAtomicReadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions aren't enforced")
+	}
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	require.NoError(t, os.WriteFile(path, []byte("from a\n"), 0o444))
+
+	err := writeFileAtomic(path, []byte("FROM a\n"), nil, nil, "")
+	assert.ErrorContains(t, err, "read-only")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "from a\n", string(data))
+}
+
+func TestWriteFileAtomicChangedSinceRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	require.NoError(t, os.WriteFile(path, []byte("from a\n"), 0o644))
+	original, readInfo, err := readFile(path)
+	require.NoError(t, err)
+
+	// An edit made while the file was being formatted is kept.
+	require.NoError(t, os.WriteFile(path, []byte("from a\nrun b\n"), 0o644))
+	err = writeFileAtomic(path, []byte("FROM a\n"), original, readInfo, "")
+	assert.ErrorIs(t, err, errChangedSinceRead)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "from a\nrun b\n", string(data))
+
+	_, readInfo, err = readFile(path)
+	require.NoError(t, err)
+	require.NoError(t, writeFileAtomic(path, []byte("FROM a\nRUN b\n"), data, readInfo, ""))
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "FROM a\nRUN b\n", string(data))
+}
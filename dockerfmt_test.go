@@ -1,44 +1,208 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/reteps/dockerfmt/lib"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestFormatter(t *testing.T) {
-	// assert equality
-	assert.Equal(t, 123, 123, "they should be equal")
-	matchingFiles, err := filepath.Glob("tests/in/*.dockerfile")
-	if err != nil {
-		t.Fatalf("Failed to find test files: %v", err)
-	}
-	c := &lib.Config{
+var update = flag.Bool("update", false, "Regenerate the files in tests/out")
+
+// testHeader marks a leading line of a tests/in file that configures the
+// formatter, e.g. "# dockerfmt-test: indent=2 space-redirects". Each header
+// line is a separate run; "out=NAME" compares that run against
+// tests/out/<file>.NAME.dockerfile instead of tests/out/<file>.dockerfile.
+const testHeader = "# dockerfmt-test:"
+
+// goldenCase is one formatter run over a tests/in file.
+type goldenCase struct {
+	outFile string
+	config  *lib.Config
+}
+
+// defaultTestConfig is the config used for files without a header.
+func defaultTestConfig() *lib.Config {
+	return &lib.Config{
 		IndentSize:      4,
 		TrailingNewline: true,
 		SpaceRedirects:  false,
 	}
-	for _, fileName := range matchingFiles {
-		t.Run(fileName, func(t *testing.T) {
-			outFile := strings.Replace(fileName, "in", "out", 1)
-			originalLines, err := lib.GetFileLines(fileName)
-			if err != nil {
-				t.Fatalf("Failed to read file %s: %v", fileName, err)
+}
+
+// parseTestHeaders strips the header lines from the start of lines and
+// returns the runs they describe.
+func parseTestHeaders(fileName string, lines []string) ([]goldenCase, []string, error) {
+	base := strings.TrimSuffix(filepath.Base(fileName), ".dockerfile")
+	outDir := filepath.Join(filepath.Dir(filepath.Dir(fileName)), "out")
+
+	// A byte order mark comes before the headers but belongs to the input.
+	var bom string
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "\ufeff"+testHeader) {
+		bom = "\ufeff"
+		lines = append([]string{strings.TrimPrefix(lines[0], bom)}, lines[1:]...)
+	}
+
+	var cases []goldenCase
+	for len(lines) > 0 && strings.HasPrefix(lines[0], testHeader) {
+		options := strings.Fields(strings.TrimPrefix(lines[0], testHeader))
+		lines = lines[1:]
+
+		c := defaultTestConfig()
+		name := base
+		for _, option := range options {
+			key, value, _ := strings.Cut(option, "=")
+			if key == "out" {
+				name = base + "." + value
+				continue
+			}
+			if err := applyTestOption(c, key, value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", fileName, err)
 			}
-			fmt.Printf("Comparing file %s with %s\n", fileName, outFile)
-			formattedLines := lib.FormatFileLines(originalLines, c)
+		}
+		cases = append(cases, goldenCase{filepath.Join(outDir, name+".dockerfile"), c})
+	}
+	if len(cases) == 0 {
+		cases = append(cases, goldenCase{filepath.Join(outDir, base+".dockerfile"), defaultTestConfig()})
+	}
+	if bom != "" && len(lines) > 0 {
+		lines = append([]string{bom + lines[0]}, lines[1:]...)
+	}
+	return cases, lines, nil
+}
 
-			// Read outFile
-			outLines, err := lib.GetFileLines(outFile)
-			if err != nil {
-				t.Fatalf("Failed to read file %s: %v", outFile, err)
+// applyTestOption sets the config field for a header option. Options are named
+// after the command line flags; a boolean option without a value is true.
+func applyTestOption(c *lib.Config, key, value string) error {
+	parseBool := func(dst *bool) error {
+		if value == "" {
+			*dst = true
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		*dst = b
+		return err
+	}
+	parseUint := func(dst *uint) error {
+		n, err := strconv.ParseUint(value, 10, 0)
+		*dst = uint(n)
+		return err
+	}
+	parseRules := func(on bool) error {
+		if c.Rules == nil {
+			c.Rules = map[string]bool{}
+		}
+		for _, name := range strings.Split(value, ",") {
+			if _, ok := lib.LookupRule(name); !ok {
+				return fmt.Errorf("unknown rule %q", name)
 			}
-			// Compare outLines with formattedLines
-			assert.Equal(t, strings.Join(outLines, ""), formattedLines, "Files should be equal")
-		})
+			c.Rules[name] = on
+		}
+		return nil
+	}
+
+	var err error
+	switch key {
+	case "indent":
+		err = parseUint(&c.IndentSize)
+	case "use-tabs":
+		err = parseBool(&c.UseTabs)
+	case "line-ending":
+		c.LineEnding = value
+	case "strip-bom":
+		err = parseBool(&c.StripBOM)
+	case "newline":
+		err = parseBool(&c.TrailingNewline)
+	case "space-redirects":
+		err = parseBool(&c.SpaceRedirects)
+	case "max-blank-lines":
+		var limit uint
+		err = parseUint(&limit)
+		c.MaxBlankLines = &limit
+	case "blank-line-before-stage":
+		err = parseBool(&c.BlankLineBeforeStage)
+	case "group-directives":
+		c.GroupDirectives = strings.Split(value, ",")
+	case "trim-leading-blank-lines":
+		err = parseBool(&c.TrimLeadingBlankLines)
+	case "enable-rules":
+		err = parseRules(true)
+	case "disable-rules":
+		err = parseRules(false)
+	case "comment-space":
+		err = parseBool(&c.CommentSpace)
+	case "reflow-comments":
+		err = parseBool(&c.ReflowComments)
+	case "line-width":
+		err = parseUint(&c.LineWidth)
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("option %q: %w", key, err)
+	}
+	return nil
+}
+
+func TestFormatter(t *testing.T) {
+	matchingFiles, err := filepath.Glob("tests/in/*.dockerfile")
+	if err != nil {
+		t.Fatalf("Failed to find test files: %v", err)
+	}
+	for _, fileName := range matchingFiles {
+		originalLines, err := lib.GetFileLines(fileName)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %v", fileName, err)
+		}
+		cases, lines, err := parseTestHeaders(fileName, originalLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range cases {
+			t.Run(tc.outFile, func(t *testing.T) {
+				fmt.Printf("Comparing file %s with %s\n", fileName, tc.outFile)
+				formattedLines := lib.FormatFileLines(lines, tc.config)
+
+				if *update {
+					require.NoError(t, os.WriteFile(tc.outFile, []byte(formattedLines), 0644))
+					return
+				}
+
+				// Read outFile
+				outLines, err := lib.GetFileLines(tc.outFile)
+				if err != nil {
+					t.Fatalf("Failed to read file %s: %v", tc.outFile, err)
+				}
+				// Compare outLines with formattedLines
+				assert.Equal(t, strings.Join(outLines, ""), formattedLines, "Files should be equal")
+			})
+		}
+	}
+}
+
+// TestVerifyGoldens checks that every golden output builds the same image as
+// its input and formats to itself.
+func TestVerifyGoldens(t *testing.T) {
+	matchingFiles, err := filepath.Glob("tests/in/*.dockerfile")
+	require.NoError(t, err)
+	for _, fileName := range matchingFiles {
+		originalLines, err := lib.GetFileLines(fileName)
+		require.NoError(t, err)
+		cases, lines, err := parseTestHeaders(fileName, originalLines)
+		require.NoError(t, err)
+		for _, tc := range cases {
+			t.Run(tc.outFile, func(t *testing.T) {
+				formatted, err := os.ReadFile(tc.outFile)
+				require.NoError(t, err)
+				assert.NoError(t, lib.NewFormatter(tc.config).Verify(strings.Join(lines, ""), string(formatted)))
+			})
+		}
 	}
 }
@@ -9,29 +9,211 @@
 package main
 
 import (
-	"strings"
+	"encoding/json"
+	"fmt"
 	"syscall/js"
 
 	"github.com/reteps/dockerfmt/lib"
 )
 
-func formatBytes(_ js.Value, args []js.Value) any {
-	contents := args[0].String()
-	indentSize := uint(args[1].Int())
-	newlineFlag := args[2].Bool()
-	spaceRedirects := args[3].Bool()
+// Go can't throw into JS from a callback, so failures are returned as Error
+// objects (with a "line" property, 0 if unknown) and the JS wrapper throws them.
+func jsError(err error) js.Value {
+	e := js.Global().Get("Error").New(err.Error())
+	e.Set("line", lib.ErrorLine(err))
+	return e
+}
+
+// export wraps fn so that errors and panics come back to JS as Error objects,
+// rather than taking down the Go runtime.
+func export(name string, fn func(args []js.Value) (any, error)) {
+	js.Global().Set(name, js.FuncOf(func(_ js.Value, args []js.Value) (result any) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = jsError(fmt.Errorf("dockerfmt: %v", r))
+			}
+		}()
+		result, err := fn(args)
+		if err != nil {
+			return jsError(err)
+		}
+		return result
+	}))
+}
+
+// configFromOptions builds a Config from a JS options object. Every field is
+// optional; missing ones use the CLI defaults.
+func configFromOptions(options js.Value) (*lib.Config, error) {
+	c := &lib.Config{IndentSize: 4, LineWidth: 80}
+	if options.Type() != js.TypeObject {
+		return c, nil
+	}
+	uintOption := func(name string, dst *uint) {
+		if v := options.Get(name); v.Type() == js.TypeNumber && v.Int() >= 0 {
+			*dst = uint(v.Int())
+		}
+	}
+	boolOption := func(name string, dst *bool) {
+		if v := options.Get(name); v.Type() == js.TypeBoolean {
+			*dst = v.Bool()
+		}
+	}
+
+	uintOption("indent", &c.IndentSize)
+	boolOption("useTabs", &c.UseTabs)
+	boolOption("trailingNewline", &c.TrailingNewline)
+	boolOption("stripBOM", &c.StripBOM)
+	if v := options.Get("lineEnding"); v.Type() == js.TypeString {
+		c.LineEnding = v.String()
+	}
+	boolOption("spaceRedirects", &c.SpaceRedirects)
+	if v := options.Get("maxBlankLines"); v.Type() == js.TypeNumber && v.Int() >= 0 {
+		limit := uint(v.Int())
+		c.MaxBlankLines = &limit
+	}
+	boolOption("blankLineBeforeStage", &c.BlankLineBeforeStage)
+	boolOption("trimLeadingBlankLines", &c.TrimLeadingBlankLines)
+	boolOption("commentSpace", &c.CommentSpace)
+	boolOption("reflowComments", &c.ReflowComments)
+	uintOption("lineWidth", &c.LineWidth)
+	boolOption("sortDockerignore", &c.SortDockerignore)
+
+	if v := options.Get("groupDirectives"); v.Type() == js.TypeObject {
+		for i := range v.Length() {
+			c.GroupDirectives = append(c.GroupDirectives, v.Index(i).String())
+		}
+	}
+	if v := options.Get("rules"); v.Type() == js.TypeObject {
+		keys := js.Global().Get("Object").Call("keys", v)
+		c.Rules = map[string]bool{}
+		for i := range keys.Length() {
+			name := keys.Index(i).String()
+			if _, ok := lib.LookupRule(name); !ok {
+				return nil, fmt.Errorf("unknown rule %q", name)
+			}
+			c.Rules[name] = v.Get(name).Truthy()
+		}
+	}
+	return c, nil
+}
+
+func diagnosticsToJS(diagnostics []lib.Diagnostic) []any {
+	out := make([]any, len(diagnostics))
+	for i, d := range diagnostics {
+		out[i] = map[string]any{
+			"line":    d.Line,
+			"endLine": d.EndLine,
+			"rule":    d.Rule,
+			"message": d.Message,
+			"url":     d.URL,
+		}
+	}
+	return out
+}
+
+// formatArgs formats the (contents, options) arguments shared by the exported
+// functions.
+func formatArgs(args []js.Value) (original string, formatted string, err error) {
+	original = args[0].String()
+	var options js.Value
+	if len(args) > 1 {
+		options = args[1]
+	}
+	c, err := configFromOptions(options)
+	if err != nil {
+		return "", "", err
+	}
+	out, err := lib.NewFormatter(c).FormatBytes([]byte(original))
+	return original, string(out), err
+}
+
+// format(contents, options) returns {output, diagnostics}.
+func format(args []js.Value) (any, error) {
+	original, formatted, err := formatArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	// Formatting doesn't need what buildkit's build checks do (e.g. a FROM
+	// before RUN), so when they can't run, their error is the diagnostic.
+	diagnostics, err := lib.Lint([]byte(original))
+	if err != nil {
+		line := lib.ErrorLine(err)
+		diagnostics = []lib.Diagnostic{{Line: line, EndLine: line, Message: err.Error()}}
+	}
+	return map[string]any{
+		"output":      formatted,
+		"diagnostics": diagnosticsToJS(diagnostics),
+	}, nil
+}
+
+// formatDockerignore(contents, options) returns the formatted .dockerignore
+// file.
+func formatDockerignore(args []js.Value) (any, error) {
+	var options js.Value
+	if len(args) > 1 {
+		options = args[1]
+	}
+	c, err := configFromOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return string(lib.NewFormatter(c).FormatDockerignore([]byte(args[0].String()))), nil
+}
+
+// check(contents, options) reports whether contents is already formatted.
+func check(args []js.Value) (any, error) {
+	original, formatted, err := formatArgs(args)
+	return original == formatted, err
+}
+
+// diff(contents, options, fileName) returns a unified diff of the formatting
+// changes, or "" if there are none.
+func diff(args []js.Value) (any, error) {
+	original, formatted, err := formatArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	name := "Dockerfile"
+	if len(args) > 2 && args[2].Type() == js.TypeString {
+		name = args[2].String()
+	}
+	return lib.Diff(name, original, formatted), nil
+}
 
-	originalLines := strings.SplitAfter(contents, "\n")
-	c := &lib.Config{
-		IndentSize:      indentSize,
-		TrailingNewline: newlineFlag,
-		SpaceRedirects:  spaceRedirects,
+// lint(contents) returns buildkit's diagnostics for contents.
+func lint(args []js.Value) (any, error) {
+	diagnostics, err := lib.Lint([]byte(args[0].String()))
+	if err != nil {
+		return nil, err
+	}
+	return diagnosticsToJS(diagnostics), nil
+}
+
+// parse(contents, options) returns the syntax tree dockerfmt parses from
+// contents; options.shell adds the shell syntax tree of RUN bodies.
+func parse(args []js.Value) (any, error) {
+	var opts lib.ASTOptions
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		opts.Shell = args[1].Get("shell").Truthy()
+	}
+	ast, err := lib.ParseAST([]byte(args[0].String()), opts)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(ast)
+	if err != nil {
+		return nil, err
 	}
-	return lib.FormatFileLines(originalLines, c)
+	return js.Global().Get("JSON").Call("parse", string(b)), nil
 }
 
 func main() {
-	js.Global().Set("__dockerfmt_formatBytes", js.FuncOf(formatBytes))
+	export("__dockerfmt_format", format)
+	export("__dockerfmt_check", check)
+	export("__dockerfmt_diff", diff)
+	export("__dockerfmt_lint", lint)
+	export("__dockerfmt_parse", parse)
+	export("__dockerfmt_formatDockerignore", formatDockerignore)
 	// Block forever to keep the Go runtime alive for subsequent calls.
 	select {}
 }
@@ -1,6 +1,15 @@
 import { describe, it } from 'node:test'
 import assert from 'node:assert/strict'
-import { formatDockerfileContents } from './node.js'
+import {
+    checkDockerfileContents,
+    diffDockerfileContents,
+    DockerfmtError,
+    formatDockerfileContents,
+    formatDockerfileContentsWithDiagnostics,
+    formatDockerignoreContents,
+    lintDockerfileContents,
+    parseDockerfileContents,
+} from './node.js'
 
 const defaultOptions = {
     indent: 4,
@@ -80,3 +89,132 @@ RUN echo a \\
         assert.ok(result.includes('  && echo b'))
     })
 })
+
+describe('options', () => {
+    it('accepts every config field', async () => {
+        const input = 'from alpine\nrun echo hi\n#comment\n'
+        const result = await formatDockerfileContents(input, {
+            ...defaultOptions,
+            commentSpace: true,
+            rules: { 'uppercase-directives': false },
+        })
+        assert.equal(result, 'from alpine\nrun echo hi\n# comment\n')
+    })
+
+    it('rejects unknown rules', async () => {
+        await assert.rejects(
+            formatDockerfileContents('FROM alpine', {
+                ...defaultOptions,
+                rules: { bogus: true },
+            }),
+            /unknown rule "bogus"/,
+        )
+    })
+})
+
+describe('formatDockerfileContentsWithDiagnostics', () => {
+    it('returns the output and diagnostics', async () => {
+        const input = 'FROM alpine AS Build\nRUN echo hi\n'
+        const result = await formatDockerfileContentsWithDiagnostics(
+            input,
+            defaultOptions,
+        )
+        assert.equal(result.output, 'FROM alpine AS build\nRUN echo hi\n')
+        assert.deepEqual(
+            result.diagnostics.map((d) => [d.line, d.rule]),
+            [[1, 'StageNameCasing']],
+        )
+    })
+
+    it('formats contents that fail the build checks', async () => {
+        for (const input of ['RUN echo hi\n', 'FROM alpine\nFOO bar\n']) {
+            const result = await formatDockerfileContentsWithDiagnostics(
+                input,
+                defaultOptions,
+            )
+            assert.equal(result.output, input)
+            assert.equal(result.diagnostics.length, 1)
+        }
+    })
+
+    it('throws an error with the line on parse failures', async () => {
+        await assert.rejects(
+            formatDockerfileContentsWithDiagnostics(
+                'FROM alpine\nRUN <<EOF\n',
+                defaultOptions,
+            ),
+            (err: DockerfmtError) => {
+                assert.ok(err instanceof Error)
+                assert.equal(err.line, 2)
+                return true
+            },
+        )
+    })
+})
+
+describe('check, diff, lint and parse', () => {
+    it('checks whether contents are formatted', async () => {
+        assert.equal(
+            await checkDockerfileContents('FROM alpine\n', defaultOptions),
+            true,
+        )
+        assert.equal(
+            await checkDockerfileContents('from alpine\n', defaultOptions),
+            false,
+        )
+    })
+
+    it('diffs the formatting changes', async () => {
+        const diff = await diffDockerfileContents(
+            'from alpine\n',
+            defaultOptions,
+            'Dockerfile.dev',
+        )
+        assert.ok(diff.startsWith('--- Dockerfile.dev\n+++ Dockerfile.dev\n'))
+        assert.ok(diff.includes('-from alpine\n+FROM alpine\n'))
+    })
+
+    it('lints', async () => {
+        const diagnostics = await lintDockerfileContents(
+            'FROM alpine\nMAINTAINER me\n',
+        )
+        assert.equal(diagnostics[0].rule, 'MaintainerDeprecated')
+        assert.equal(diagnostics[0].line, 2)
+    })
+
+    it('parses', async () => {
+        const ast = await parseDockerfileContents(
+            'FROM alpine\nCOPY --chmod=644 a b\n',
+        )
+        const copy = ast.children![1]
+        assert.equal(copy.directive, 'COPY')
+        assert.deepEqual(copy.flags, ['--chmod=644'])
+        assert.deepEqual(copy.args, ['a', 'b'])
+        assert.equal(copy.startLine, 2)
+    })
+
+    it('parses shell bodies', async () => {
+        const ast = await parseDockerfileContents('RUN echo hi\n', {
+            shell: true,
+        })
+        const run = ast.children![0]
+        assert.equal((run.shell as { Type: string }).Type, 'File')
+    })
+})
+
+describe('formatDockerignoreContents', () => {
+    it('sorts patterns with sortDockerignore', async () => {
+        const input = 'b\n./a\n'
+        assert.equal(
+            await formatDockerignoreContents(input, defaultOptions),
+            'b\na\n',
+        )
+        assert.equal(
+            await formatDockerignoreContents(input, {
+                ...defaultOptions,
+                sortDockerignore: true,
+            }),
+            'a\nb\n',
+        )
+    })
+})
@@ -2,15 +2,107 @@ import './wasm_exec.js'
 
 export interface FormatOptions {
     indent: number
+    useTabs?: boolean
     trailingNewline: boolean
+    lineEnding?: 'auto' | 'lf' | 'crlf'
+    stripBOM?: boolean
     spaceRedirects: boolean
+    maxBlankLines?: number
+    blankLineBeforeStage?: boolean
+    groupDirectives?: string[]
+    trimLeadingBlankLines?: boolean
+    /** Switches rules (see `dockerfmt --list-rules`) on or off by name. */
+    rules?: Record<string, boolean>
+    commentSpace?: boolean
+    reflowComments?: boolean
+    lineWidth?: number
+    /** Sort neighbouring patterns in `.dockerignore` files. */
+    sortDockerignore?: boolean
 }
 
-export const formatDockerfileContents = async (
-    fileContents: string,
-    options: FormatOptions,
+/** A problem buildkit reports that doesn't stop the Dockerfile from building. */
+export interface Diagnostic {
+    /** 1-based line, or 0 if the diagnostic isn't tied to a line. */
+    line: number
+    endLine: number
+    /** The build check that reported it, or empty for parser warnings. */
+    rule: string
+    message: string
+    url: string
+}
+
+export interface FormatResult {
+    output: string
+    diagnostics: Diagnostic[]
+}
+
+/**
+ * A node of the syntax tree dockerfmt parses. The root only has `children`,
+ * one per directive; an ONBUILD node's child is the directive it wraps.
+ */
+export interface DockerfileNode {
+    directive?: string
+    flags?: string[]
+    args?: string[]
+    heredocs?: {
+        name: string
+        content: string
+        expand: boolean
+        chomp: boolean
+    }[]
+    startLine?: number
+    endLine?: number
+    attributes?: Record<string, boolean>
+    original?: string
+    /** The shell syntax tree of a RUN body, with `parse`'s `shell` option. */
+    shell?: unknown
+    shellError?: string
+    children?: DockerfileNode[]
+}
+
+export interface ParseOptions {
+    /** Include the parsed shell syntax tree of RUN bodies. */
+    shell?: boolean
+}
+
+/** Thrown when a Dockerfile can't be parsed. */
+export interface DockerfmtError extends Error {
+    /** 1-based line of the error, or 0 if unknown. */
+    line: number
+}
+
+interface WasmExports {
+    format(contents: string, options: FormatOptions): FormatResult | Error
+    check(contents: string, options: FormatOptions): boolean | Error
+    diff(
+        contents: string,
+        options: FormatOptions,
+        fileName: string,
+    ): string | Error
+    lint(contents: string): Diagnostic[] | Error
+    parse(contents: string, options?: ParseOptions): DockerfileNode | Error
+    formatDockerignore(contents: string, options: FormatOptions): string | Error
+}
+
+// The Go runtime stays alive after it registers its functions, so it is
+// started once per WASM loader and reused for every call.
+const instances = new WeakMap<
+    () => Promise<Buffer>,
+    Promise<WasmExports>
+>()
+
+const loadWasm = (getWasm: () => Promise<Buffer>) => {
+    let instance = instances.get(getWasm)
+    if (instance === undefined) {
+        instance = instantiate(getWasm)
+        instances.set(getWasm, instance)
+    }
+    return instance
+}
+
+const instantiate = async (
     getWasm: () => Promise<Buffer>,
-) => {
+): Promise<WasmExports> => {
     // Use our namespaced Go class instead of globalThis.Go to avoid conflicts
     // with other Go WASM packages (see wasm_exec.js modifications).
     const GoClass = (globalThis as any).__dockerfmt_Go as typeof Go
@@ -25,27 +117,106 @@ export const formatDockerfileContents = async (
     /**
      * Do not await this promise, because it only resolves once the go main()
      * function has exited. But we need the main function to stay alive to be
-     * able to call the formatBytes function.
+     * able to call the exported functions.
      */
     go.run(wasm.instance)
 
-    const formatBytes = (globalThis as any).__dockerfmt_formatBytes as (
-        contents: string,
-        indent: number,
-        trailingNewline: boolean,
-        spaceRedirects: boolean,
-    ) => string
+    const exports: Record<string, unknown> = {}
+    for (const name of [
+        'format',
+        'check',
+        'diff',
+        'lint',
+        'parse',
+        'formatDockerignore',
+    ]) {
+        const fn = (globalThis as any)[`__dockerfmt_${name}`]
+        if (typeof fn !== 'function') {
+            throw new Error(`dockerfmt WASM module did not register ${name}`)
+        }
+        exports[name] = fn
+    }
+    return exports as unknown as WasmExports
+}
 
-    if (typeof formatBytes !== 'function') {
-        throw new Error('dockerfmt WASM module did not register formatBytes')
+// The Go side returns errors instead of throwing them.
+const unwrap = <T>(result: T | Error): T => {
+    if (result instanceof Error) {
+        throw result as DockerfmtError
     }
+    return result
+}
 
-    return formatBytes(
+export const formatDockerfileContents = async (
+    fileContents: string,
+    options: FormatOptions,
+    getWasm: () => Promise<Buffer>,
+) => {
+    const result = await formatDockerfileContentsWithDiagnostics(
         fileContents,
-        options.indent,
-        options.trailingNewline,
-        options.spaceRedirects,
+        options,
+        getWasm,
     )
+    return result.output
+}
+
+export const formatDockerfileContentsWithDiagnostics = async (
+    fileContents: string,
+    options: FormatOptions,
+    getWasm: () => Promise<Buffer>,
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.format(fileContents, options))
+}
+
+/** Reports whether the contents are already formatted. */
+export const checkDockerfileContents = async (
+    fileContents: string,
+    options: FormatOptions,
+    getWasm: () => Promise<Buffer>,
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.check(fileContents, options))
+}
+
+/** Returns a unified diff of the formatting changes, or "" if there are none. */
+export const diffDockerfileContents = async (
+    fileContents: string,
+    options: FormatOptions,
+    getWasm: () => Promise<Buffer>,
+    fileName = 'Dockerfile',
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.diff(fileContents, options, fileName))
+}
+
+/** Returns buildkit's parser warnings and build check findings. */
+export const lintDockerfileContents = async (
+    fileContents: string,
+    getWasm: () => Promise<Buffer>,
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.lint(fileContents))
+}
+
+/** Returns the syntax tree dockerfmt parses from the contents. */
+export const parseDockerfileContents = async (
+    fileContents: string,
+    getWasm: () => Promise<Buffer>,
+    options: ParseOptions = {},
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.parse(fileContents, options))
+}
+
+/** Formats the contents of a `.dockerignore` file. */
+export const formatDockerignoreContents = async (
+    fileContents: string,
+    options: FormatOptions,
+    getWasm: () => Promise<Buffer>,
+) => {
+    const wasm = await loadWasm(getWasm)
+    return unwrap(wasm.formatDockerignore(fileContents, options))
 }
 
 export const formatDockerfile = () => {
@@ -53,3 +224,9 @@ export const formatDockerfile = () => {
         '`formatDockerfile` is not implemented in the browser. Use `formatDockerfileContents` instead.',
     )
 }
+
+export const formatDockerignore = () => {
+    throw new Error(
+        '`formatDockerignore` is not implemented in the browser. Use `formatDockerignoreContents` instead.',
+    )
+}
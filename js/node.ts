@@ -3,8 +3,19 @@ import path from 'node:path'
 import { fileURLToPath } from 'node:url'
 
 import {
+    checkDockerfileContents as checkDockerfileContents_,
+    diffDockerfileContents as diffDockerfileContents_,
     formatDockerfileContents as formatDockerfileContents_,
+    formatDockerfileContentsWithDiagnostics as formatDockerfileContentsWithDiagnostics_,
+    formatDockerignoreContents as formatDockerignoreContents_,
+    lintDockerfileContents as lintDockerfileContents_,
+    parseDockerfileContents as parseDockerfileContents_,
+    Diagnostic,
+    DockerfileNode,
+    DockerfmtError,
     FormatOptions,
+    FormatResult,
+    ParseOptions,
 } from './format.js'
 
 const getWasm = () => {
@@ -23,6 +34,50 @@ export const formatDockerfileContents = async (
     return formatDockerfileContents_(fileContents, options, getWasm)
 }
 
+export const formatDockerfileContentsWithDiagnostics = async (
+    fileContents: string,
+    options: FormatOptions,
+) => {
+    return formatDockerfileContentsWithDiagnostics_(
+        fileContents,
+        options,
+        getWasm,
+    )
+}
+
+export const checkDockerfileContents = async (
+    fileContents: string,
+    options: FormatOptions,
+) => {
+    return checkDockerfileContents_(fileContents, options, getWasm)
+}
+
+export const diffDockerfileContents = async (
+    fileContents: string,
+    options: FormatOptions,
+    fileName?: string,
+) => {
+    return diffDockerfileContents_(fileContents, options, getWasm, fileName)
+}
+
+export const lintDockerfileContents = async (fileContents: string) => {
+    return lintDockerfileContents_(fileContents, getWasm)
+}
+
+export const parseDockerfileContents = async (
+    fileContents: string,
+    options?: ParseOptions,
+) => {
+    return parseDockerfileContents_(fileContents, getWasm, options)
+}
+
+export const formatDockerignoreContents = async (
+    fileContents: string,
+    options: FormatOptions,
+) => {
+    return formatDockerignoreContents_(fileContents, options, getWasm)
+}
+
 export const formatDockerfile = async (
     fileName: string,
     options: FormatOptions,
@@ -32,4 +87,19 @@ export const formatDockerfile = async (
     return formatDockerfileContents(fileContents, options)
 }
 
-export { FormatOptions }
+export const formatDockerignore = async (
+    fileName: string,
+    options: FormatOptions,
+) => {
+    const fileBuffer = await fs.readFile(fileName)
+    return formatDockerignoreContents(fileBuffer.toString(), options)
+}
+
+export {
+    Diagnostic,
+    DockerfileNode,
+    DockerfmtError,
+    FormatOptions,
+    FormatResult,
+    ParseOptions,
+}
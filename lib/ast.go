@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"mvdan.cc/sh/v3/syntax"
+	"mvdan.cc/sh/v3/syntax/typedjson"
+)
+
+// ASTNode is an ExtendedNode as exported by ExportAST, for inspecting how the
+// formatter sees a file. The root node only has Children, one per directive.
+type ASTNode struct {
+	Directive  string          `json:"directive,omitempty"`
+	Flags      []string        `json:"flags,omitempty"`
+	Args       []string        `json:"args,omitempty"`
+	Heredocs   []ASTHeredoc    `json:"heredocs,omitempty"`
+	StartLine  int             `json:"startLine,omitempty"`
+	EndLine    int             `json:"endLine,omitempty"`
+	Attributes map[string]bool `json:"attributes,omitempty"`
+	Original   string          `json:"original,omitempty"`
+	// Shell is the shfmt syntax tree of a RUN body (see ASTOptions.Shell), or
+	// ShellError why it couldn't be parsed.
+	Shell      json.RawMessage `json:"shell,omitempty"`
+	ShellError string          `json:"shellError,omitempty"`
+	// Children are the directives of the root, or the directive an ONBUILD
+	// wraps.
+	Children []*ASTNode `json:"children,omitempty"`
+}
+
+// ASTHeredoc is a heredoc attached to a directive.
+type ASTHeredoc struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Expand  bool   `json:"expand"`
+	Chomp   bool   `json:"chomp"`
+}
+
+// ASTOptions controls what ExportAST includes.
+type ASTOptions struct {
+	// Shell adds the parsed shell syntax tree of each RUN body.
+	Shell bool
+}
+
+// ParseAST parses src and exports the resulting tree.
+func ParseAST(src []byte, opts ASTOptions) (*ASTNode, error) {
+	result, err := parser.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.SplitAfter(string(src), "\n")
+	return ExportAST(BuildExtendedNode(result.AST, lines), opts), nil
+}
+
+// ExportAST converts n and its directives to an ASTNode.
+func ExportAST(n *ExtendedNode, opts ASTOptions) *ASTNode {
+	out := &ASTNode{
+		Directive: n.Value,
+		Flags:     n.Flags,
+		StartLine: n.StartLine,
+		EndLine:   n.EndLine,
+	}
+	// The root's text is the whole file.
+	if n.Value != "" {
+		out.Original = n.OriginalMultiline
+		if out.Original == "" {
+			out.Original = n.Original
+		}
+	}
+	for name, on := range n.Attributes {
+		if on {
+			if out.Attributes == nil {
+				out.Attributes = map[string]bool{}
+			}
+			out.Attributes[name] = true
+		}
+	}
+	for _, h := range n.Heredocs {
+		out.Heredocs = append(out.Heredocs, ASTHeredoc{Name: h.Name, Content: h.Content, Expand: h.Expand, Chomp: h.Chomp})
+	}
+	for _, child := range n.Children {
+		out.Children = append(out.Children, ExportAST(child, opts))
+	}
+	for next := n.Next; next != nil; next = next.Next {
+		if len(next.Children) > 0 {
+			// ONBUILD holds the directive it wraps as its argument's child.
+			for _, child := range next.Children {
+				out.Children = append(out.Children, ExportAST(child, opts))
+			}
+			continue
+		}
+		out.Args = append(out.Args, next.Value)
+	}
+
+	if opts.Shell && strings.EqualFold(n.Value, command.Run) && !n.Attributes["json"] {
+		script := strings.Join(out.Args, " ")
+		if len(n.Heredocs) == 1 {
+			script = n.Heredocs[0].Content
+		}
+		out.Shell, out.ShellError = shellAST(script)
+	}
+	return out
+}
+
+func shellAST(script string) (json.RawMessage, string) {
+	f, err := syntax.NewParser(syntax.KeepComments(true)).Parse(strings.NewReader(script), "")
+	if err != nil {
+		return nil, err.Error()
+	}
+	var b bytes.Buffer
+	if err := typedjson.Encode(&b, f); err != nil {
+		return nil, err.Error()
+	}
+	return bytes.TrimSpace(b.Bytes()), ""
+}
+
+// WriteTree writes n as an indented tree, one directive per line followed by
+// its details.
+func (n *ASTNode) WriteTree(w io.Writer) error {
+	var b strings.Builder
+	n.writeTree(&b, "")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (n *ASTNode) writeTree(b *strings.Builder, indent string) {
+	if n.Directive != "" {
+		fmt.Fprintf(b, "%s%s", indent, n.Directive)
+		switch {
+		case n.StartLine == 0:
+		case n.StartLine == n.EndLine:
+			fmt.Fprintf(b, " (line %d)", n.StartLine)
+		default:
+			fmt.Fprintf(b, " (lines %d-%d)", n.StartLine, n.EndLine)
+		}
+		b.WriteString("\n")
+		detail := indent + "  "
+		for _, flag := range n.Flags {
+			fmt.Fprintf(b, "%sflag %q\n", detail, flag)
+		}
+		for _, arg := range n.Args {
+			fmt.Fprintf(b, "%sarg %q\n", detail, arg)
+		}
+		for _, h := range n.Heredocs {
+			fmt.Fprintf(b, "%sheredoc %s %q\n", detail, h.Name, h.Content)
+		}
+		for _, name := range slices.Sorted(maps.Keys(n.Attributes)) {
+			fmt.Fprintf(b, "%sattribute %s\n", detail, name)
+		}
+		if n.Shell != nil {
+			fmt.Fprintf(b, "%sshell %s\n", detail, n.Shell)
+		}
+		if n.ShellError != "" {
+			fmt.Fprintf(b, "%sshell error: %s\n", detail, n.ShellError)
+		}
+		indent = detail
+	}
+	for _, child := range n.Children {
+		child.writeTree(b, indent)
+	}
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// reBakeHeredoc matches a bake HCL attribute that sets dockerfile-inline to a
+// heredoc, capturing the "-" of an indented heredoc and the delimiter.
+var reBakeHeredoc = regexp.MustCompile(`^\s*dockerfile-inline\s*=\s*<<(-?)([A-Za-z_][A-Za-z0-9_-]*)\s*$`)
+
+// FormatBakeHCL formats the inline Dockerfiles (dockerfile-inline) of a
+// docker-bake.hcl file and reports each one it found. Only heredocs are
+// rewritten; an indented heredoc ("<<-EOT") keeps its indentation.
+func (f *Formatter) FormatBakeHCL(src []byte) ([]byte, []EmbeddedDockerfile) {
+	block := f.embeddedFormatter()
+
+	var out strings.Builder
+	var blocks []EmbeddedDockerfile
+	lines := strings.SplitAfter(string(src), "\n")
+	for i := 0; i < len(lines); i++ {
+		out.WriteString(lines[i])
+		m := reBakeHeredoc.FindStringSubmatch(strings.TrimRight(lines[i], "\r\n"))
+		if m == nil {
+			continue
+		}
+		indented, delimiter := m[1] == "-", m[2]
+
+		end := i + 1
+		for end < len(lines) && strings.TrimSpace(lines[end]) != delimiter {
+			end++
+		}
+		if end == len(lines) {
+			// Not a complete heredoc; leave the rest of the file alone.
+			continue
+		}
+
+		body := lines[i+1 : end]
+		indent := ""
+		if indented {
+			indent = commonIndent(body)
+		}
+		dedented := make([]string, len(body))
+		for j, line := range body {
+			dedented[j] = strings.TrimPrefix(line, indent)
+		}
+
+		formatted, e := block.formatEmbedded(strings.Join(dedented, ""), i+2)
+		if e.Changed {
+			out.WriteString(indentLines(formatted, indent))
+		} else {
+			out.WriteString(strings.Join(body, ""))
+		}
+		blocks = append(blocks, e)
+		out.WriteString(lines[end])
+		i = end
+	}
+	return []byte(out.String()), blocks
+}
+
+// commonIndent returns the leading whitespace shared by every non-blank line.
+func commonIndent(lines []string) string {
+	indent, first := "", true
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if first {
+			indent, first = lineIndent, false
+			continue
+		}
+		for !strings.HasPrefix(lineIndent, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	return indent
+}
+
+// FormatBakeJSON formats the inline Dockerfiles (dockerfile-inline) of a
+// docker-bake.json file and reports each one it found. Each string is
+// re-encoded in place, leaving the rest of the file as written.
+func (f *Formatter) FormatBakeJSON(src []byte) ([]byte, []EmbeddedDockerfile, error) {
+	block := f.embeddedFormatter()
+
+	var out bytes.Buffer
+	var blocks []EmbeddedDockerfile
+	copied := 0
+
+	// Each open object or array, with the key of the current object member.
+	type frame struct {
+		object    bool
+		expectKey bool
+		key       string
+	}
+	var stack []frame
+	dec := json.NewDecoder(bytes.NewReader(src))
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if len(stack) > 0 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		var top *frame
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+		if top != nil && top.object {
+			if top.expectKey {
+				top.key, _ = tok.(string)
+				top.expectKey = false
+				continue
+			}
+			top.expectKey = true
+		}
+
+		switch tok := tok.(type) {
+		case json.Delim:
+			stack = append(stack, frame{object: tok == '{', expectKey: true})
+		case string:
+			// Only a target's own attribute: {"target": {"name": {...}}}.
+			if len(stack) != 3 || stack[0].key != "target" || top.key != "dockerfile-inline" {
+				continue
+			}
+			// The token starts at its opening quote, after the ":" and any
+			// whitespace that precede it.
+			start := int(offset) + bytes.IndexByte(src[offset:], '"')
+			end := int(dec.InputOffset())
+			line := bytes.Count(src[:start], []byte("\n")) + 1
+			formatted, e := block.formatEmbedded(tok, line)
+			e.inline = true
+			// Keep a string without a final line break that way.
+			if !strings.HasSuffix(tok, "\n") {
+				formatted = strings.TrimSuffix(formatted, "\n")
+				e.Changed = formatted != tok
+			}
+			if e.Changed {
+				var b strings.Builder
+				writeJSONString(&b, formatted)
+				out.Write(src[copied:start])
+				out.WriteString(b.String())
+				copied = end
+			}
+			blocks = append(blocks, e)
+		}
+	}
+	out.Write(src[copied:])
+	return out.Bytes(), blocks, nil
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"strings"
+)
+
+// defaultLineWidth is used for comment reflow when Config.LineWidth is unset.
+const defaultLineWidth = 80
+
+// normalizeComments applies the opt-in comment rules to a block of stripped
+// comment and blank lines. Parser directives at the start of the file and
+// shebang lines are never modified.
+func normalizeComments(lines []string, c *Config, atFileStart bool) []string {
+	if !c.CommentSpace && !c.ReflowComments {
+		return lines
+	}
+	skip := 0
+	if atFileStart {
+		skip = parserDirectiveCount(lines)
+	}
+	if c.CommentSpace {
+		for i := skip; i < len(lines); i++ {
+			lines[i] = ensureCommentSpace(lines[i])
+		}
+	}
+	if c.ReflowComments {
+		width := int(c.LineWidth)
+		if width == 0 {
+			width = defaultLineWidth
+		}
+		lines = append(lines[:skip:skip], reflowComments(lines[skip:], width)...)
+	}
+	return lines
+}
+
+// ensureCommentSpace inserts a space after the "#" of a comment ("#foo" becomes
+// "# foo"). Shebangs, banners ("####") and empty comments are left alone.
+func ensureCommentSpace(line string) string {
+	rest, ok := strings.CutPrefix(line, "#")
+	if !ok || rest == "" || strings.ContainsRune(" \t\n#!", rune(rest[0])) {
+		return line
+	}
+	return "# " + rest
+}
+
+// isProseComment reports whether line is a plain "# text" comment that may be
+// reflowed. List items, indented text and ignore markers are kept as written.
+func isProseComment(line string) bool {
+	text, ok := strings.CutPrefix(strings.TrimRight(line, "\n"), "# ")
+	if !ok || text == "" || text[0] == ' ' || text[0] == '\t' {
+		return false
+	}
+	if strings.TrimSpace(line) == "# dockerfmt-ignore" {
+		return false
+	}
+	first, _, _ := strings.Cut(text, " ")
+	switch {
+	case first == "-" || first == "*" || first == "+":
+		return false
+	case strings.HasSuffix(first, ".") && strings.Trim(first, "0123456789.") == "":
+		return false
+	}
+	return true
+}
+
+// reflowComments rewraps each paragraph of prose comments that has a line
+// longer than width. Paragraphs that already fit are left untouched so that
+// intentional short lines survive.
+func reflowComments(lines []string, width int) []string {
+	out := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); {
+		if !isProseComment(lines[i]) {
+			out = append(out, lines[i])
+			i++
+			continue
+		}
+		j := i
+		tooLong := false
+		for j < len(lines) && isProseComment(lines[j]) {
+			tooLong = tooLong || len(strings.TrimRight(lines[j], "\n")) > width
+			j++
+		}
+		if tooLong {
+			out = append(out, wrapComment(lines[i:j], width)...)
+		} else {
+			out = append(out, lines[i:j]...)
+		}
+		i = j
+	}
+	return out
+}
+
+// wrapComment greedily fills words from a paragraph of "# " comments into
+// lines no longer than width. Words longer than width get a line of their own.
+func wrapComment(paragraph []string, width int) []string {
+	var words []string
+	for _, line := range paragraph {
+		words = append(words, strings.Fields(strings.TrimPrefix(line, "#"))...)
+	}
+
+	var out []string
+	current := "#"
+	for _, word := range words {
+		if current != "#" && len(current)+1+len(word) > width {
+			out = append(out, current+"\n")
+			current = "#"
+		}
+		current += " " + word
+	}
+	out = append(out, current+"\n")
+	return out
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FormatCompose formats the inline Dockerfiles of a Docker Compose file
+// (services.*.build.dockerfile_inline) and reports each one it found. Only
+// literal block scalars ("dockerfile_inline: |") are formatted, keeping their
+// indentation and chomping indicator; other styles are reported as skipped.
+func (f *Formatter) FormatCompose(src []byte) ([]byte, []EmbeddedDockerfile, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, nil, err
+	}
+	var values []*yaml.Node
+	if len(doc.Content) > 0 {
+		for _, service := range yamlMapValues(yamlMapValue(doc.Content[0], "services")) {
+			if v := yamlMapValue(yamlMapValue(service, "build"), "dockerfile_inline"); v != nil && v.Kind == yaml.ScalarNode {
+				values = append(values, v)
+			}
+		}
+	}
+
+	block := f.embeddedFormatter()
+	lines := strings.SplitAfter(string(src), "\n")
+	var blocks []EmbeddedDockerfile
+	// Rewrite from the end so earlier line numbers stay valid.
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+		start, end, indent, ok := literalBlockLines(lines, v)
+		if !ok {
+			blocks = append(blocks, EmbeddedDockerfile{Line: v.Line, Skipped: true})
+			continue
+		}
+		formatted, e := block.formatEmbedded(v.Value, start+1)
+		// A clipped or stripped block ends with at most one line break, so
+		// compare it without its chomping.
+		e.Changed = e.Err == nil && formatted != strings.TrimRight(v.Value, "\n")+"\n"
+		if e.Changed {
+			lines = append(lines[:start], append([]string{indentLines(formatted, indent)}, lines[end:]...)...)
+		}
+		blocks = append(blocks, e)
+	}
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return []byte(strings.Join(lines, "")), blocks, nil
+}
+
+// yamlMapValue returns the value of key in the mapping n, or nil.
+func yamlMapValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlMapValues returns the values of the mapping n.
+func yamlMapValues(n *yaml.Node) []*yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	var values []*yaml.Node
+	for i := 1; i < len(n.Content); i += 2 {
+		values = append(values, n.Content[i])
+	}
+	return values
+}
+
+// literalBlockLines returns the 0-based range of lines holding the content of
+// the literal block scalar v, up to its last non-blank line, and the content's
+// indentation. It returns false for other scalars and for blocks with an
+// explicit indentation indicator.
+func literalBlockLines(lines []string, v *yaml.Node) (start, end int, indent string, ok bool) {
+	if v.Style != yaml.LiteralStyle || v.Line < 1 || v.Line > len(lines) {
+		return 0, 0, "", false
+	}
+	header := lines[v.Line-1]
+	if v.Column < 1 || v.Column > len(header) {
+		return 0, 0, "", false
+	}
+	header = strings.TrimRight(header[v.Column-1:], "\r\n")
+	if indicators, _, _ := strings.Cut(header, "#"); strings.ContainsAny(indicators, "123456789") {
+		return 0, 0, "", false
+	}
+
+	start = v.Line
+	for end = start; end < len(lines); end++ {
+		line := strings.TrimRight(lines[end], "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+		if indent == "" {
+			if lineIndent == "" {
+				break
+			}
+			indent = lineIndent
+		} else if !strings.HasPrefix(lineIndent, indent) {
+			break
+		}
+	}
+	// Trailing blank lines stay where they are.
+	for end > start && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return start, end, indent, indent != ""
+}
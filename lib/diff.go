@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Diff returns a unified diff from original to formatted, labeling both sides
+// with name. It returns "" when they are equal.
+func Diff(name, original, formatted string) string {
+	if original == formatted {
+		return ""
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(original),
+		B:        diffLines(formatted),
+		FromFile: name,
+		ToFile:   name,
+		Context:  3,
+	})
+	return diff
+}
+
+// diffLines splits s into lines for difflib, marking a missing final newline
+// the way diff does.
+func diffLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if last := len(lines) - 1; lines[last] == "" {
+		lines = lines[:last]
+	} else {
+		lines[last] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/moby/patternmatcher"
+)
+
+// ignoreLine is one line of a .dockerignore file.
+type ignoreLine struct {
+	text string
+	// pattern is set for lines buildkit reads as patterns.
+	pattern bool
+	// exception is set for "!" patterns, which re-include what earlier
+	// patterns excluded.
+	exception bool
+	// key is the pattern as buildkit matches it, without the "!", for
+	// comparing patterns.
+	key string
+}
+
+// parseIgnoreLine classifies line the way buildkit's ignorefile.ReadAll reads
+// it: only lines starting with "#" are comments, so an indented "#" starts a
+// pattern.
+func parseIgnoreLine(line string) ignoreLine {
+	if strings.HasPrefix(line, "#") {
+		return ignoreLine{text: strings.TrimRight(line, " \t")}
+	}
+	text := strings.TrimSpace(line)
+	if text == "" {
+		return ignoreLine{}
+	}
+	l := ignoreLine{text: text, pattern: true}
+	rest, exception := strings.CutPrefix(text, "!")
+	rest = strings.TrimSpace(rest)
+	l.exception = exception
+	l.key = rest
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		l.key = strings.TrimPrefix(path.Clean(rest), "/")
+		if l.key == "" {
+			l.key = "/"
+		}
+	}
+	return l
+}
+
+// FormatDockerignore formats a .dockerignore file: it trims whitespace,
+// collapses runs of blank lines, writes patterns in their clean form ("./a/"
+// becomes "a") and removes patterns that repeat an earlier one. A leading "/"
+// is kept. With SortDockerignore, neighbouring patterns are sorted too.
+// Patterns that start with "#" after some indentation are kept as written, as
+// trimming them would turn them into comments.
+func (f *Formatter) FormatDockerignore(src []byte) []byte {
+	c := f.Config
+	content, enc := normalizeSource(string(src), c)
+
+	var lines []ignoreLine
+	// The patterns of each kind seen since the last overlapping one of the
+	// other kind; repeating one of them has no effect.
+	seen := map[bool]map[string]bool{false: {}, true: {}}
+	for _, raw := range strings.Split(content, "\n") {
+		l := parseIgnoreLine(raw)
+		switch {
+		case !l.pattern:
+			if l.text != "" && c.CommentSpace {
+				l.text = ensureCommentSpace(l.text)
+			}
+		case strings.HasPrefix(l.key, "#"):
+			l.text = strings.TrimRight(raw, " \t")
+		default:
+			if seen[l.exception][l.key] {
+				continue
+			}
+			seen[l.exception][l.key] = true
+			maps.DeleteFunc(seen[!l.exception], func(key string, _ bool) bool {
+				return ignorePatternsOverlap(key, l.key)
+			})
+			l.text = cleanIgnorePattern(l.text)
+		}
+		lines = append(lines, l)
+	}
+
+	if c.SortDockerignore {
+		sortIgnorePatterns(lines)
+	}
+
+	var out strings.Builder
+	blank := true
+	for _, l := range lines {
+		if l.text == "" {
+			blank = true
+			continue
+		}
+		if blank && out.Len() > 0 {
+			out.WriteString("\n")
+		}
+		blank = false
+		out.WriteString(l.text)
+		out.WriteString("\n")
+	}
+
+	output := strings.TrimRight(out.String(), "\n")
+	if c.TrailingNewline && output != "" {
+		output += "\n"
+	}
+	return []byte(enc.restore(output))
+}
+
+// cleanIgnorePattern returns the clean form of the trimmed pattern text,
+// keeping its "!" and leading "/".
+func cleanIgnorePattern(text string) string {
+	rest, exception := strings.CutPrefix(text, "!")
+	rest = strings.TrimSpace(rest)
+	if rest == "" {
+		return text
+	}
+	rest = path.Clean(rest)
+	if exception {
+		return "!" + rest
+	}
+	return rest
+}
+
+// sortIgnorePatterns sorts each run of neighbouring patterns of the same kind.
+// Patterns of one kind can be applied in any order, so exceptions and the
+// comments and blank lines that delimit groups stay where they are.
+func sortIgnorePatterns(lines []ignoreLine) {
+	for start := 0; start < len(lines); {
+		end := start + 1
+		if lines[start].pattern {
+			for end < len(lines) && lines[end].pattern && lines[end].exception == lines[start].exception {
+				end++
+			}
+			slices.SortStableFunc(lines[start:end], func(a, b ignoreLine) int {
+				return strings.Compare(a.key, b.key)
+			})
+		}
+		start = end
+	}
+}
+
+// LintDockerignore checks the patterns of a .dockerignore file, reporting
+// those that are invalid, can never match a file in the build context or are
+// undone by a later exception.
+func LintDockerignore(src []byte) []Diagnostic {
+	content, _ := normalizeSource(string(src), &Config{})
+
+	type pattern struct {
+		ignoreLine
+		line int
+	}
+	var patterns []pattern
+	var diagnostics []Diagnostic
+	report := func(line int, rule, format string, args ...any) {
+		diagnostics = append(diagnostics, Diagnostic{Line: line, EndLine: line, Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+	for i, raw := range strings.Split(content, "\n") {
+		l := parseIgnoreLine(raw)
+		if !l.pattern {
+			continue
+		}
+		line := i + 1
+		switch {
+		case strings.HasPrefix(strings.TrimLeft(raw, " \t"), "#"):
+			report(line, "IndentedIgnoreComment", "%q is a pattern, not a comment: only lines starting with # are comments", l.text)
+		case l.key == "":
+			report(line, "InvalidIgnorePattern", "%q is not a valid pattern", l.text)
+			continue
+		}
+		if _, err := patternmatcher.New([]string{l.key}); err != nil {
+			report(line, "InvalidIgnorePattern", "%q is not a valid pattern: %v", l.text, err)
+			continue
+		}
+		if l.key == ".." || strings.HasPrefix(l.key, "../") {
+			report(line, "IgnorePatternOutsideContext", "%q is outside the build context and never matches", l.text)
+			continue
+		}
+		patterns = append(patterns, pattern{l, line})
+	}
+
+	for i, p := range patterns {
+		if p.exception {
+			if !slices.ContainsFunc(patterns[:i], func(q pattern) bool {
+				return !q.exception && ignorePatternsOverlap(q.key, p.key)
+			}) {
+				report(p.line, "UnusedIgnoreException", "%q re-includes files that no earlier pattern excludes", p.text)
+			}
+			continue
+		}
+		if j := slices.IndexFunc(patterns[i+1:], func(q pattern) bool {
+			return q.exception && ignorePatternCovers(q.key, p.key)
+		}); j >= 0 {
+			report(p.line, "ShadowedIgnorePattern", "%q is undone by %q on line %d", p.text, patterns[i+1+j].text, patterns[i+1+j].line)
+		}
+	}
+
+	slices.SortStableFunc(diagnostics, func(a, b Diagnostic) int {
+		return a.Line - b.Line
+	})
+	return diagnostics
+}
+
+// hasGlob reports whether the pattern uses wildcards or escapes.
+func hasGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// ignorePatternsOverlap reports whether the patterns a and b might apply to
+// the same file. A file matches a pattern that matches it or one of its
+// parent directories, so the patterns overlap when one could match a path
+// that leads to a path the other matches. If both have wildcards, or one has
+// "**", they are assumed to overlap.
+func ignorePatternsOverlap(a, b string) bool {
+	if hasGlob(a) && hasGlob(b) {
+		return true
+	}
+	if hasGlob(b) {
+		a, b = b, a
+	}
+	dirs, names := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(dirs) && i < len(names); i++ {
+		if strings.Contains(dirs[i], "**") {
+			return true
+		}
+		if ok, err := path.Match(dirs[i], names[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ignorePatternCovers reports whether the pattern a matches every file the
+// pattern b matches: they are the same, or b names a file that a matches.
+func ignorePatternCovers(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if hasGlob(b) {
+		return false
+	}
+	matched, err := patternmatcher.MatchesOrParentMatches(b, []string{a})
+	return err == nil && matched
+}
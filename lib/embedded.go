@@ -0,0 +1,82 @@
+package lib
+
+import "strings"
+
+// EmbeddedDockerfile is a Dockerfile found inside another file: a Markdown
+// code block, or an inline Dockerfile in a compose or bake file.
+type EmbeddedDockerfile struct {
+	// Line is the 1-based line of the file where the Dockerfile starts.
+	Line int
+	// Changed reports whether formatting changed the Dockerfile.
+	Changed bool
+	// Err is why the Dockerfile couldn't be formatted, in which case it was
+	// left as it is.
+	Err error
+	// Skipped reports that the Dockerfile was left as it is because it is
+	// written in a form that isn't formatted, such as a quoted or folded YAML
+	// string.
+	Skipped bool
+
+	// inline is set for a Dockerfile held in a one-line string, whose lines
+	// don't match the file's.
+	inline bool
+	// original and formatted are the Dockerfile before and after formatting,
+	// for VerifyEmbedded.
+	original, formatted string
+}
+
+// ErrorLine returns the line of the file that Err points at, or Line if Err
+// isn't tied to a line.
+func (e EmbeddedDockerfile) ErrorLine() int {
+	if l := ErrorLine(e.Err); l > 0 && !e.inline {
+		return e.Line + l - 1
+	}
+	return e.Line
+}
+
+// embeddedFormatter returns a copy of f for formatting Dockerfiles embedded in
+// other files, where the content always ends with a line break.
+func (f *Formatter) embeddedFormatter() *Formatter {
+	c := *f.Config
+	c.TrailingNewline = true
+	return &Formatter{Config: &c, formatters: f.formatters, preHooks: f.preHooks, postHooks: f.postHooks}
+}
+
+// formatEmbedded formats content with f, reporting it as starting at line.
+// Empty content is left alone.
+func (f *Formatter) formatEmbedded(content string, line int) (string, EmbeddedDockerfile) {
+	e := EmbeddedDockerfile{Line: line}
+	if strings.TrimSpace(content) == "" {
+		return content, e
+	}
+	formatted, err := f.FormatBytes([]byte(content))
+	if err != nil {
+		e.Err = err
+		return content, e
+	}
+	e.Changed = string(formatted) != content
+	e.original, e.formatted = content, string(formatted)
+	return string(formatted), e
+}
+
+// VerifyEmbedded checks an embedded Dockerfile returned by FormatMarkdown,
+// FormatCompose, FormatBakeHCL or FormatBakeJSON the way Verify checks a
+// Dockerfile. Dockerfiles that weren't changed or couldn't be formatted pass.
+func (f *Formatter) VerifyEmbedded(e EmbeddedDockerfile) error {
+	if !e.Changed || e.Err != nil {
+		return nil
+	}
+	return f.embeddedFormatter().Verify(e.original, e.formatted)
+}
+
+// indentLines prefixes every non-blank line of s with indent.
+func indentLines(s, indent string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if strings.TrimRight(line, "\r\n") != "" {
+			b.WriteString(indent)
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
@@ -2,12 +2,13 @@ package lib
 
 import (
 	"bytes"
-	"fmt"
-	"log"
+	"context"
 	"os"
 	"regexp"
 	"slices"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/shlex"
 	"github.com/moby/buildkit/frontend/dockerfile/command"
@@ -16,12 +17,13 @@ import (
 )
 
 var (
-	reWhitespace          = regexp.MustCompile(`[ \t]`)
-	reLeadingSpaces       = regexp.MustCompile(`(?m)^ *`)
+	reLeadingSpaces       = regexp.MustCompile(`(?m)^[ \t]*`)
 	reUnescapedSemicolon  = regexp.MustCompile(`[^\\];`)
-	reCommentContinuation = regexp.MustCompile(`(\\(?:\s*` + "`#.*#`" + `\\){1,}\s*)&&(.[^\\])`)
-	reBacktickComment     = regexp.MustCompile(`([ \t]*)(?:&& )?` + "`(#.*)#` " + `\\`)
-	reMultipleNewlines    = regexp.MustCompile(`\n{3,}`)
+	reCommentContinuation = regexp.MustCompile(`(\\(?:\s*` + "`#.*#`" + `\\){1,}\s*)&&([ \t]*(?:[^\s\\]|\\[^\n]))`)
+	// reCommentBareAnd matches an "&& \" line that follows a comment block.
+	reCommentBareAnd   = regexp.MustCompile(`(\\(?:\s*` + "`#.*#`" + `\\){1,})\s*&&[ \t]*\\\n`)
+	reBacktickComment  = regexp.MustCompile(`([ \t]*)(?:&& )?` + "`(#.*)#` ?" + `\\`)
+	reMultipleNewlines = regexp.MustCompile(`\n{3,}`)
 )
 
 type ExtendedNode struct {
@@ -29,20 +31,116 @@ type ExtendedNode struct {
 	Children          []*ExtendedNode
 	Next              *ExtendedNode
 	OriginalMultiline string
+
+	// extraLabels are LABEL pairs appended to this directive's output, and
+	// relocated marks a directive whose output moved elsewhere (see
+	// relocateMaintainers). verbatim marks a directive whose flags buildkit
+	// couldn't decode, which is kept as written. beforeFrom marks a directive
+	// that comes before the first FROM.
+	extraLabels []string
+	relocated   bool
+	verbatim    bool
+	beforeFrom  bool
 }
 
 type ParseState struct {
 	CurrentLine int
-	Output      string
+	Output      strings.Builder
 	// Needed to pull in comments
 	AllOriginalLines []string
 	Config           *Config
+
+	// lastDirective and seenStage track the previously emitted directive so
+	// the blank-line policy can be applied to the gap before the next one.
+	lastDirective string
+	seenStage     bool
+	// dropped is set after a directive was removed from the output, so its
+	// surrounding blank lines don't double up.
+	dropped bool
+
+	// ctx is checked between directives; err records why formatting stopped.
+	ctx       context.Context
+	err       error
+	formatter *Formatter
 }
 
 type Config struct {
 	IndentSize      uint
 	TrailingNewline bool
 	SpaceRedirects  bool
+	// UseTabs indents with a tab instead of IndentSize spaces.
+	UseTabs bool
+	// LineEnding is the line ending of the output: LineEndingLF,
+	// LineEndingCRLF, or LineEndingAuto (the default when empty) to keep the
+	// input's.
+	LineEnding string
+	// StripBOM removes a UTF-8 byte order mark, which is kept by default.
+	StripBOM bool
+
+	// MaxBlankLines caps runs of consecutive blank lines. When nil, the
+	// default applies: runs of three or more collapse to one.
+	MaxBlankLines *uint
+	// BlankLineBeforeStage requires a blank line before every FROM after the first.
+	BlankLineBeforeStage bool
+	// GroupDirectives lists directives (e.g. ENV, ARG, LABEL) whose consecutive
+	// occurrences are not separated by blank lines.
+	GroupDirectives []string
+	// TrimLeadingBlankLines removes blank lines at the start of the file,
+	// after any parser directives.
+	TrimLeadingBlankLines bool
+
+	// Rules switches individual rewrites on or off by name (see Rules). Rules
+	// not mentioned here use their default.
+	Rules map[string]bool
+	// KeepMaintainer keeps MAINTAINER directives instead of upgrading them to
+	// LABEL.
+	//
+	// Deprecated: Turn off RuleMaintainerToLabel in Rules instead.
+	KeepMaintainer bool
+
+	// CommentSpace ensures a space after "#" in comments ("#foo" becomes
+	// "# foo"), including comments inside RUN continuations.
+	CommentSpace bool
+	// ReflowComments rewraps comment paragraphs longer than LineWidth.
+	ReflowComments bool
+	// LineWidth is the maximum line width used when reflowing comments. Zero
+	// means 80.
+	LineWidth uint
+
+	// SortDockerignore sorts neighbouring patterns when formatting a
+	// .dockerignore file.
+	SortDockerignore bool
+
+	// LineRanges, if set, limits formatting to the directives and comments
+	// that overlap these lines; everything else is kept as written.
+	LineRanges []LineRange
+}
+
+// LineRange is a range of 1-based lines, End included.
+type LineRange struct {
+	Start, End int
+}
+
+// outsideRanges reports whether LineRanges is set and none of the ranges
+// overlap lines start to end.
+func (c *Config) outsideRanges(start, end int) bool {
+	if len(c.LineRanges) == 0 {
+		return false
+	}
+	for _, r := range c.LineRanges {
+		if r.Start <= end && start <= r.End {
+			return false
+		}
+	}
+	return true
+}
+
+// indent returns the text of one level of indentation.
+func (c *Config) indent() string {
+	if c.UseTabs {
+		return "\t"
+	}
+	return strings.Repeat(" ", int(c.IndentSize))
 }
 
 // hasIgnoreComment reports whether any line in the block is a "# dockerfmt-ignore" comment.
@@ -55,15 +153,46 @@ func hasIgnoreComment(lines []string) bool {
 	return false
 }
 
+// parserDirectiveCount returns the number of leading lines that buildkit
+// treats as parser directives (e.g. "# syntax=docker/dockerfile:1").
+func parserDirectiveCount(lines []string) int {
+	var dp parser.DirectiveParser
+	for i, line := range lines {
+		d, err := dp.ParseLine([]byte(strings.TrimRight(line, "\n")))
+		if err != nil || d == nil {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+// isParserDirective reports whether line has the form of a parser directive,
+// which it is if only parser directives come before it.
+func isParserDirective(line string) bool {
+	var dp parser.DirectiveParser
+	d, _ := dp.ParseLine([]byte(strings.TrimRight(line, "\n")))
+	return d != nil
+}
+
 // directive returns the uppercased directive name (e.g. "RUN", "COPY").
 func (n *ExtendedNode) directive() string {
 	return strings.ToUpper(n.Value)
 }
 
+// keyword returns the directive keyword as it should be printed: uppercased,
+// unless the uppercase-directives rule is disabled.
+func (n *ExtendedNode) keyword(c *Config) string {
+	if c.Enabled(RuleUppercaseDirectives) {
+		return n.directive()
+	}
+	return n.Value
+}
+
 // prependFlags prepends flags (e.g. "--network=host") to content if any exist.
-// When any flag starts with "--mount", each flag is placed on its own continuation line.
+// When any flag starts with "--mount", each flag is placed on its own continuation
+// line (the split-mount-flags rule).
 func prependFlags(flags []string, content string, c *Config) string {
-	return prependFlagsImpl(flags, content, c, hasMountFlag(flags))
+	return prependFlagsImpl(flags, content, c, splitFlags(flags, c))
 }
 
 // prependFlagsImpl prepends flags to content. When multiline is true, each flag
@@ -72,8 +201,17 @@ func prependFlagsImpl(flags []string, content string, c *Config, multiline bool)
 	if len(flags) == 0 {
 		return content
 	}
+	flags = slices.Clone(flags)
+	for i, flag := range flags {
+		flags[i] = quoteFlag(flag)
+	}
+	if strings.TrimSpace(content) == "" {
+		return strings.Join(flags, " ") + content
+	}
+	// On a line of its own, content starting with "#" would be a comment.
+	multiline = multiline && !strings.HasPrefix(content, "#")
 	if multiline {
-		indent := strings.Repeat(" ", int(c.IndentSize))
+		indent := c.indent()
 		var b strings.Builder
 		for _, flag := range flags {
 			b.WriteString(flag)
@@ -86,12 +224,36 @@ func prependFlagsImpl(flags []string, content string, c *Config, multiline bool)
 	return strings.Join(flags, " ") + " " + content
 }
 
+// quoteFlag quotes the value of a flag that contains whitespace, quotes or
+// backslashes. buildkit removes quotes and escapes from flags as it parses
+// them, so a flag written as --opt="a b" reaches the formatter as --opt=a b.
+func quoteFlag(flag string) string {
+	if !strings.ContainsAny(flag, " \t\n\"'\\") {
+		return flag
+	}
+	// Keep the flag name outside the quotes so it is still recognized.
+	end := strings.IndexFunc(flag[2:], func(r rune) bool {
+		return r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) + 2
+	if flag[end] == '=' {
+		end++
+	}
+	prefix, value := flag[:end], flag[end:]
+	return prefix + `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
 // hasLineContinuation reports whether the node's original source spanned multiple
 // lines via "\" continuations.
 func hasLineContinuation(n *ExtendedNode) bool {
 	return strings.Contains(n.OriginalMultiline, "\\\n")
 }
 
+// splitFlags reports whether flags must each go on their own line because one
+// of them is a --mount flag.
+func splitFlags(flags []string, c *Config) bool {
+	return c.Enabled(RuleSplitMountFlags) && hasMountFlag(flags)
+}
+
 func hasMountFlag(flags []string) bool {
 	for _, f := range flags {
 		if strings.HasPrefix(f, "--mount") {
@@ -111,41 +273,92 @@ func extractDirectiveContent(n *ExtendedNode, flagCount int) (string, bool) {
 	originalTrimmed := strings.TrimLeft(originalText, " \t")
 
 	if flagCount > 0 {
-		// When flags span multiple lines with line continuations, a simple
-		// whitespace split can't reliably skip them. Instead, find the last
-		// flag in the original text and return everything after it.
-		lastFlag := n.Flags[flagCount-1]
-		idx := strings.LastIndex(originalTrimmed, lastFlag)
-		if idx == -1 {
+		// Flags may span multiple lines with line continuations, so walk past
+		// the directive keyword and each flag token rather than splitting on
+		// whitespace. Flags are skipped by position, not by text, since earlier
+		// passes may have rewritten their values (see normalizeStageNames).
+		rest, ok := cutKeyword(originalTrimmed)
+		if !ok {
 			return "", false
 		}
-		rest := originalTrimmed[idx+len(lastFlag):]
-		// Skip whitespace and line continuations to reach content.
-		for {
-			rest = strings.TrimLeft(rest, " \t")
-			if strings.HasPrefix(rest, "\\\n") {
-				rest = rest[2:]
-				continue
+		for range flagCount {
+			rest = skipContinuations(rest)
+			if !strings.HasPrefix(rest, "--") {
+				return "", false
 			}
-			break
+			rest = rest[flagTokenEnd(rest):]
 		}
+		rest = skipContinuations(rest)
 		if rest == "" {
 			return "", false
 		}
 		return rest, true
 	}
 
-	parts := reWhitespace.Split(originalTrimmed, 2)
-	if len(parts) < 2 {
+	return cutKeyword(originalTrimmed)
+}
+
+// cutKeyword returns what follows the directive keyword at the start of s. The
+// keyword may be followed directly by a "\" line continuation.
+func cutKeyword(s string) (string, bool) {
+	end := strings.IndexAny(s, " \t\\")
+	if end < 0 {
 		return "", false
 	}
-	return parts[1], true
+	if s[end] == '\\' {
+		return s[end:], true
+	}
+	return s[end+1:], true
+}
+
+// skipContinuations skips leading whitespace and "\" line continuations,
+// including one at the end of the file.
+func skipContinuations(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		rest, ok := strings.CutPrefix(s, "\\")
+		rest = strings.TrimLeft(rest, " \t")
+		if ok && (rest == "" || rest[0] == '\n') {
+			s = strings.TrimPrefix(rest, "\n")
+			continue
+		}
+		return s
+	}
+}
+
+// flagTokenEnd returns the index just past the flag at the start of s. Quoted
+// sections may contain whitespace.
+func flagTokenEnd(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			if quote == 0 {
+				return i
+			}
+		case ch == '\\':
+			// buildkit treats a backslash as an escape, even inside quotes
+			i++
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			return i
+		}
+	}
+	return len(s)
 }
 
-var nodeFormatters map[string]func(*ExtendedNode, *Config) string
+// defaultFormatters holds the built-in directive formatters, keyed by lowercase
+// directive name. Formatter instances start from a copy (see DefaultFormatters).
+var defaultFormatters map[string]DirectiveFormatter
 
 func init() {
-	nodeFormatters = map[string]func(*ExtendedNode, *Config) string{
+	defaultFormatters = map[string]DirectiveFormatter{
 		command.Add:         spaceSeparated(flagsOnOwnLines),
 		command.Arg:         formatBasic,
 		command.Cmd:         formatCmd,
@@ -153,7 +366,7 @@ func init() {
 		command.Entrypoint:  formatCmd,
 		command.Env:         formatEnv,
 		command.Expose:      spaceSeparated(argsOnOwnLines),
-		command.From:        spaceSeparated(collapseLines),
+		command.From:        formatFrom,
 		command.Healthcheck: formatBasic,
 		command.Label:       formatBasic,
 		command.Maintainer:  formatMaintainer,
@@ -167,9 +380,11 @@ func init() {
 	}
 }
 
+// FormatNode formats a single directive with the built-in formatters. It
+// returns false for directives it doesn't know.
 func FormatNode(ast *ExtendedNode, c *Config) (string, bool) {
 	nodeName := strings.ToLower(ast.Value)
-	fmtFunc := nodeFormatters[nodeName]
+	fmtFunc := defaultFormatters[nodeName]
 	if fmtFunc == nil {
 		return "", false
 	}
@@ -180,37 +395,153 @@ func (df *ParseState) processNode(ast *ExtendedNode) {
 	if ast.StartLine == 0 || ast.EndLine == 0 {
 		return
 	}
+	// The root only holds the directives; each handles the gap before it.
+	if len(ast.Children) > 0 {
+		for _, child := range ast.Children {
+			if df.err = df.ctx.Err(); df.err != nil {
+				return
+			}
+			df.processNode(child)
+		}
+		return
+	}
+	// Arguments (the Next chain) are formatted along with their directive.
 
 	// Collect any comments between the current line and this node.
 	ignored := false
 	if df.CurrentLine != ast.StartLine {
 		commentLines := df.AllOriginalLines[df.CurrentLine : ast.StartLine-1]
-		df.Output += FormatComments(commentLines)
+		if df.Config.outsideRanges(df.CurrentLine+1, ast.StartLine-1) {
+			df.Output.WriteString(strings.Join(commentLines, ""))
+		} else {
+			df.Output.WriteString(df.formatGap(commentLines, ast))
+		}
 		ignored = hasIgnoreComment(commentLines)
 		df.CurrentLine = ast.StartLine
 	}
 
-	if ignored {
+	if df.Config.outsideRanges(ast.StartLine, ast.EndLine) {
+		df.Output.WriteString(ast.OriginalMultiline)
+		df.CurrentLine = ast.EndLine
+	} else if ast.relocated {
+		df.CurrentLine = ast.EndLine
+		df.dropped = true
+	} else if ignored || ast.verbatim {
 		// # dockerfmt-ignore: emit the directive verbatim.
-		df.Output += ast.OriginalMultiline
+		df.Output.WriteString(appendLabels(ast, ast.OriginalMultiline, df.Config))
+		df.CurrentLine = ast.EndLine
+	} else if output, ok := df.formatter.FormatNode(ast); ok {
+		df.Output.WriteString(appendLabels(ast, output, df.Config))
 		df.CurrentLine = ast.EndLine
-	} else if output, ok := FormatNode(ast, df.Config); ok {
-		df.Output += output
+	} else {
+		// Unknown directive: keep it rather than dropping it from the output.
+		df.Output.WriteString(appendLabels(ast, ast.OriginalMultiline, df.Config))
 		df.CurrentLine = ast.EndLine
 	}
+	if ast.Value != "" {
+		df.lastDirective = ast.directive()
+		df.seenStage = df.seenStage || df.lastDirective == "FROM"
+	}
+}
+
+// formatGap formats the comments and blank lines that precede next, applying
+// the configured blank-line policy.
+func (df *ParseState) formatGap(lines []string, next *ExtendedNode) string {
+	c := df.Config
+	gap := strings.SplitAfter(df.formatComments(lines), "\n")
+	gap = gap[:len(gap)-1] // drop the empty element after the final newline
+
+	if df.CurrentLine == 0 && c.TrimLeadingBlankLines {
+		start := parserDirectiveCount(gap)
+		end := start
+		for end < len(gap) && gap[end] == "\n" {
+			end++
+		}
+		gap = slices.Delete(gap, start, end)
+	}
+
+	directive := next.directive()
+	if directive == df.lastDirective && slices.ContainsFunc(c.GroupDirectives, func(d string) bool {
+		return strings.EqualFold(d, directive)
+	}) {
+		gap = slices.DeleteFunc(gap, func(line string) bool { return line == "\n" })
+	}
+
+	if df.dropped {
+		// Don't leave a blank line at the start of the output or next to
+		// another one where a directive was removed.
+		df.dropped = false
+		if output := df.Output.String(); output == "" || strings.HasSuffix(output, "\n\n") {
+			for len(gap) > 0 && gap[0] == "\n" {
+				gap = gap[1:]
+			}
+		}
+	}
+
+	if c.BlankLineBeforeStage && directive == "FROM" && df.seenStage && !slices.Contains(gap, "\n") {
+		gap = slices.Insert(gap, 0, "\n")
+	}
+
+	// A blank line ends the parser directives. Where one was removed, put it
+	// back if the comment after it would otherwise be read as another.
+	if df.CurrentLine == 0 {
+		if n := parserDirectiveCount(lines); n < len(gap) && isParserDirective(gap[n]) {
+			gap = slices.Insert(gap, n, "\n")
+		}
+	}
+
+	return strings.Join(gap, "")
+}
 
-	for _, child := range ast.Children {
-		df.processNode(child)
+// formatComments formats comment and blank lines, honoring MaxBlankLines and
+// the comment normalization options.
+func (df *ParseState) formatComments(lines []string) string {
+	var content string
+	if df.Config.MaxBlankLines == nil {
+		content = FormatComments(lines)
+	} else {
+		content = limitBlankLines(StripWhitespace(strings.Join(lines, ""), false), *df.Config.MaxBlankLines)
 	}
+	if !df.Config.CommentSpace && !df.Config.ReflowComments {
+		return content
+	}
+	normalized := normalizeComments(strings.SplitAfter(content, "\n"), df.Config, df.CurrentLine == 0)
+	return strings.Join(normalized, "")
+}
 
-	if ast.Node.Next != nil { // Must use .Node.Next (parser.Node), not .Next (ExtendedNode)
-		df.processNode(ast.Next)
+// limitBlankLines drops blank lines beyond the first max in every run.
+func limitBlankLines(content string, max uint) string {
+	var b strings.Builder
+	b.Grow(len(content))
+	run := uint(0)
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "\n" {
+			run++
+			if run > max {
+				continue
+			}
+		} else {
+			run = 0
+		}
+		b.WriteString(line)
 	}
+	return b.String()
 }
 
+// FormatOnBuild formats an ONBUILD directive, formatting the wrapped directive
+// with the built-in formatters.
 func FormatOnBuild(n *ExtendedNode, c *Config) string {
-	if len(n.Node.Next.Children) == 1 {
-		output, ok := FormatNode(n.Next.Children[0], c)
+	return formatOnBuild(n, c, FormatNode)
+}
+
+func formatOnBuild(n *ExtendedNode, c *Config, formatNode func(*ExtendedNode, *Config) (string, bool)) string {
+	// The heredocs belong to the ONBUILD node, not the directive it wraps, so
+	// formatting that directive would drop their bodies.
+	if len(n.Heredocs) > 0 {
+		return n.OriginalMultiline
+	}
+	if n.Node.Next != nil && len(n.Node.Next.Children) == 1 {
+		output, ok := formatNode(n.Next.Children[0], c)
 		if ok {
 			// Inner directives nested under ONBUILD have StartLine=0, so their
 			// OriginalMultiline is empty and formatters that fall back to n.Original
@@ -218,37 +549,17 @@ func FormatOnBuild(n *ExtendedNode, c *Config) string {
 			if !strings.HasSuffix(output, "\n") {
 				output += "\n"
 			}
-			return n.directive() + " " + output
+			return n.keyword(c) + " " + output
 		}
 	}
 
 	return n.OriginalMultiline
 }
 
+// FormatFileLines formats a Dockerfile given as lines that keep their trailing
+// newlines (see strings.SplitAfter), using the built-in formatters.
 func FormatFileLines(fileLines []string, c *Config) string {
-	result, err := parser.Parse(strings.NewReader(strings.Join(fileLines, "")))
-	if err != nil {
-		log.Printf("%s\n", strings.Join(fileLines, ""))
-		log.Fatalf("Error parsing file: %v", err)
-	}
-
-	parseState := &ParseState{
-		AllOriginalLines: fileLines,
-		Config:           c,
-	}
-	rootNode := BuildExtendedNode(result.AST, fileLines)
-	parseState.processNode(rootNode)
-
-	// Append any trailing comments after the last directive.
-	if parseState.CurrentLine < len(parseState.AllOriginalLines) {
-		parseState.Output += FormatComments(parseState.AllOriginalLines[parseState.CurrentLine:])
-	}
-
-	parseState.Output = strings.TrimRight(parseState.Output, "\n")
-	if c.TrailingNewline {
-		parseState.Output += "\n"
-	}
-	return parseState.Output
+	return NewFormatter(c).FormatFileLines(fileLines)
 }
 
 // BuildExtendedNode wraps a parser.Node tree, attaching the original multiline
@@ -258,40 +569,76 @@ func BuildExtendedNode(n *parser.Node, fileLines []string) *ExtendedNode {
 		return nil
 	}
 
-	en := &ExtendedNode{Node: n}
+	// Walk the Next chain (a directive's arguments) iteratively, since it can
+	// be as long as the argument list.
+	var head *ExtendedNode
+	verbatim := false
+	for prev := &head; n != nil; n = n.Next {
+		en := &ExtendedNode{Node: n}
+		for i, flag := range n.Flags {
+			var ok bool
+			if n.Flags[i], ok = repairFlag(flag); !ok {
+				verbatim = true
+			}
+		}
 
-	// Reconstruct the original text (StartLine is 1-indexed, fileLines is 0-indexed)
-	if n.StartLine > 0 && n.EndLine > 0 {
-		for i := n.StartLine - 1; i < n.EndLine; i++ {
-			en.OriginalMultiline += fileLines[i]
+		// Reconstruct the original text (StartLine is 1-indexed, fileLines is 0-indexed)
+		if n.StartLine > 0 && n.EndLine > 0 {
+			en.OriginalMultiline = strings.Join(fileLines[n.StartLine-1:n.EndLine], "")
 		}
-	}
 
-	if len(n.Children) > 0 {
-		en.Children = make([]*ExtendedNode, 0, len(n.Children))
-		for _, child := range n.Children {
-			if extChild := BuildExtendedNode(child, fileLines); extChild != nil {
-				en.Children = append(en.Children, extChild)
+		if len(n.Children) > 0 {
+			en.Children = make([]*ExtendedNode, 0, len(n.Children))
+			for _, child := range n.Children {
+				if extChild := BuildExtendedNode(child, fileLines); extChild != nil {
+					en.Children = append(en.Children, extChild)
+					verbatim = verbatim || extChild.verbatim
+				}
 			}
 		}
-	}
 
-	if n.Next != nil {
-		en.Next = BuildExtendedNode(n.Next, fileLines)
+		*prev = en
+		prev = &en.Next
 	}
+	head.verbatim = verbatim
+	return head
+}
 
-	return en
+// repairFlag undoes buildkit's decoding of flags byte by byte, which turns each
+// byte of a multi-byte UTF-8 character into a rune of its own. It reports
+// false if the flag lost bytes: buildkit splits on U+0085 and U+00A0, which
+// also occur as the second byte of a character (e.g. "à" is C3 A0).
+func repairFlag(flag string) (string, bool) {
+	b := make([]byte, 0, len(flag))
+	for _, r := range flag {
+		if r > 0xff {
+			return flag, true
+		}
+		b = append(b, byte(r))
+	}
+	if !utf8.Valid(b) {
+		return flag, false
+	}
+	return string(b), true
 }
 
 func formatEnv(n *ExtendedNode, c *Config) string {
 	// Handle missing arguments safely
 	if n.Next == nil {
-		return n.directive()
+		return n.keyword(c) + "\n"
 	}
 
-	// Only the legacy format will have an empty 3rd child
-	if n.Next.Next.Next.Value == "" {
-		return n.directive() + " " + n.Next.Value + "=" + n.Next.Next.Value + "\n"
+	// Only the legacy format will have an empty 3rd child. A value of several
+	// words is quoted, unless it has quotes or escapes of its own.
+	if n.Next.Next.Next.Value == "" && c.Enabled(RuleEnvKeyValue) &&
+		!strings.ContainsAny(n.Next.Value, "\"'\\") {
+		value := n.Next.Next.Value
+		switch {
+		case !strings.ContainsAny(value, " \t"):
+			return n.keyword(c) + " " + n.Next.Value + "=" + value + "\n"
+		case !strings.ContainsAny(value, "\"'\\"):
+			return n.keyword(c) + " " + n.Next.Value + "=\"" + value + "\"\n"
+		}
 	}
 
 	// Otherwise, we have a valid env command; fall back to original if parsing fails
@@ -300,9 +647,23 @@ func formatEnv(n *ExtendedNode, c *Config) string {
 		return n.OriginalMultiline
 	}
 	content := StripWhitespace(rawContent, true)
-	// Indent all lines with indentSize spaces
-	content = strings.Trim(reLeadingSpaces.ReplaceAllString(content, strings.Repeat(" ", int(c.IndentSize))), " ")
-	return n.directive() + " " + content
+	lines := strings.SplitAfter(content, "\n")
+	prev := lines[0]
+	for _, line := range lines[1:] {
+		// buildkit drops comment and blank lines inside a continuation, so
+		// the word carries on past them.
+		if trimmed := strings.TrimLeft(line, " \t"); trimmed == "\n" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if continuesWord(prev, line) {
+			// Indenting would split the word; keep the lines as written
+			return n.keyword(c) + " " + strings.TrimLeft(content, " ")
+		}
+		prev = line
+	}
+	// Indent all lines by one level
+	content = strings.Trim(reLeadingSpaces.ReplaceAllString(content, c.indent()), " \t")
+	return n.keyword(c) + " " + content
 }
 
 func formatShell(content string, hereDoc bool, c *Config) string {
@@ -316,19 +677,160 @@ func formatShell(content string, hereDoc bool, c *Config) string {
 		return content
 	}
 
+	// A command that is only a comment (e.g. "RUN # note") is passed to the
+	// shell as written; there's nothing to format. The same goes for one that
+	// starts with a comment, since buildkit joins continued lines into it.
+	if !hasShellCode(content) || strings.HasPrefix(strings.TrimLeft(content, " \t"), "#") {
+		return content
+	}
+
+	// buildkit joins the line after an inline comment ending in "\" into the
+	// comment, while shfmt moves it into the command.
+	if !hereDoc && hasContinuedInlineComment(content) {
+		return content
+	}
+
+	// Blank lines (or lines holding just a "\") after the first can only be
+	// empty continuation lines, which buildkit skips but the shell would take
+	// as the end of the command.
+	if !hereDoc {
+		content = dropEmptyContinuations(content)
+	}
+
+	// A trailing line continuation (e.g. at the end of the file) continues into
+	// nothing; buildkit drops it.
+	if trimmed := strings.TrimRight(content, " \t\n"); !hereDoc && strings.HasSuffix(trimmed, "\\") {
+		content = strings.TrimRight(trimmed, " \t\n\\") + "\n"
+	}
+
+	// Comments after the last command would become arguments of it as
+	// placeholders, so format the commands alone and put the comments back.
+	if code, trailer := splitTrailingComments(content); !hereDoc && trailer != nil {
+		code = strings.TrimRight(formatShell(code, hereDoc, c), " \t\n\\") + " \\\n"
+		indent := c.indent()
+		for _, comment := range trailer {
+			if c.CommentSpace {
+				comment = ensureCommentSpace(comment)
+			}
+			code += indent + comment + "\n"
+		}
+		return code
+	}
+
+	original := content
 	if !hereDoc {
-		content = preprocessShellComments(content)
+		content = preprocessShellComments(content, c)
 	}
 
-	content = formatBash(content, c)
+	formatted, err := formatBash(content, c)
+	if err != nil {
+		// Leave shell that shfmt can't parse as written
+		return original
+	}
+	content = formatted
 
 	if !hereDoc {
-		content = postprocessShellComments(content, c)
+		// shfmt may itself leave an empty continuation line inside a string.
+		content = dropEmptyContinuations(postprocessShellComments(content, c))
+		// The comment placeholders can still change the command in corner
+		// cases (e.g. pairing with a stray backtick), and shfmt may break lines
+		// without a continuation (e.g. after "&") or drop the ";" after a
+		// trailing "\\"; keep such input as written.
+		if canonicalShell(stripShellComments(content)) != canonicalShell(stripShellComments(StripWhitespace(original, true))) || !continuesEachLine(content) ||
+			strings.HasSuffix(strings.TrimRight(content, " \t\n"), "\\") {
+			return original
+		}
 	}
 
 	return content
 }
 
+// dropEmptyContinuations removes blank and "\"-only lines after the first.
+func dropEmptyContinuations(content string) string {
+	first, rest, ok := strings.Cut(content, "\n")
+	if !ok {
+		return content
+	}
+	return first + "\n" + filterLines(rest, func(line string) bool {
+		line = strings.TrimSpace(line)
+		return line != "" && line != "\\"
+	})
+}
+
+// hasShellCode reports whether content has a line that isn't blank or a comment.
+func hasShellCode(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.Trim(line, " \t\\")
+		if trimmed != "" && trimmed[0] != '#' {
+			return true
+		}
+	}
+	return false
+}
+
+// splitTrailingComments splits the comment lines after the last line of code
+// off content. Blank lines among them are dropped.
+func splitTrailingComments(content string) (string, []string) {
+	lines := strings.SplitAfter(content, "\n")
+	end := len(lines)
+	var comments []string
+	for end > 0 {
+		line := strings.Trim(lines[end-1], " \t\n")
+		if line != "" && line[0] != '#' {
+			break
+		}
+		if line != "" {
+			comments = append([]string{line}, comments...)
+		}
+		end--
+	}
+	return strings.Join(lines[:end], ""), comments
+}
+
+// hasContinuedInlineComment reports whether content has a line of code with a
+// trailing comment that ends in a line continuation.
+func hasContinuedInlineComment(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") && strings.HasSuffix(line, "\\") &&
+			(strings.Contains(line, " #") || strings.Contains(line, "\t#")) {
+			return true
+		}
+	}
+	return false
+}
+
+// continuesEachLine reports whether every line of content but the last is a
+// comment or ends in a line continuation, so that it stays one directive.
+func continuesEachLine(content string) bool {
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		line = strings.TrimSpace(line)
+		if !strings.HasSuffix(line, "\\") && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// stripShellComments removes the comment lines from content.
+func stripShellComments(content string) string {
+	return filterLines(content, func(line string) bool {
+		return !strings.HasPrefix(strings.TrimLeft(line, " \t"), "#")
+	})
+}
+
+// filterLines returns the lines of content for which keep returns true.
+func filterLines(content string, keep func(line string) bool) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if keep(line) {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
 // preprocessShellComments wraps shell comments in backtick placeholders so they
 // survive shfmt formatting. The placeholder format is `# text#`\, which shfmt
 // treats as a command substitution. Backticks inside comments are backslash-escaped
@@ -342,7 +844,7 @@ func formatShell(content string, hereDoc bool, c *Config) string {
 //
 // the && is moved before the comment block so shfmt sees a continuous chain,
 // and placeholders inside chains get && attached so shfmt doesn't break them apart.
-func preprocessShellComments(content string) string {
+func preprocessShellComments(content string, c *Config) string {
 	content = StripWhitespace(content, true)
 	lines := strings.SplitAfter(content, "\n")
 
@@ -355,6 +857,9 @@ func preprocessShellComments(content string) string {
 		}
 		ws := line[:len(line)-len(trimmed)]
 		comment := strings.TrimRight(trimmed, " \t\n")
+		if c.CommentSpace {
+			comment = ensureCommentSpace(comment)
+		}
 		// Escape backticks so they nest safely inside the backtick placeholder.
 		// Inside backtick command substitutions, \` represents a literal backtick.
 		comment = strings.ReplaceAll(comment, "`", "\\`")
@@ -368,8 +873,10 @@ func preprocessShellComments(content string) string {
 	// Step 2: move && before comment blocks.
 	// When we see:  code \<nl> placeholder(s) <nl> && cmd
 	// transform to: code &&\<nl> placeholder(s) <nl> cmd
+	// A bare "&& \" line after the block is handled the same way.
 	content = strings.Join(lines, "")
 	content = reCommentContinuation.ReplaceAllString(content, "&&$1$2")
+	content = reCommentBareAnd.ReplaceAllString(content, "&&$1\n")
 	lines = strings.SplitAfter(content, "\n")
 
 	// Step 3: attach && to placeholders inside && chains so shfmt keeps them
@@ -402,7 +909,7 @@ func postprocessShellComments(content string, c *Config) string {
 	// Single pass to fix comment indentation, restore escaped backticks,
 	// and detect leading comments.
 	lines := strings.SplitAfter(content, "\n")
-	indent := strings.Repeat(" ", int(c.IndentSize))
+	indent := c.indent()
 	prevIsComment := false
 	prevCommentSpacing := ""
 	firstLineIsComment := false
@@ -444,26 +951,61 @@ func postprocessShellComments(content string, c *Config) string {
 func formatRun(n *ExtendedNode, c *Config) string {
 	hereDoc := false
 	flags := n.Flags
+	shellConfig := c
 
 	var content string
-	if len(n.Heredocs) >= 1 {
+	if len(n.Heredocs) > 1 {
+		// Only a lone heredoc is known to be the script
+		content, _ = GetHeredoc(n)
+		return n.keyword(c) + " " + prependFlags(normalizeMountFlags(n, c), content, c)
+	} else if len(n.Heredocs) == 1 {
 		content = n.Heredocs[0].Content
 		hereDoc = true
+		if n.Heredocs[0].Chomp {
+			// <<- strips leading tabs only, so the body must be indented with tabs
+			tabs := *c
+			tabs.UseTabs = true
+			shellConfig = &tabs
+		}
 	} else {
-		content, _ = extractDirectiveContent(n, len(flags))
+		var ok bool
+		content, ok = extractDirectiveContent(n, len(flags))
+		if (!ok || n.Next == nil || strings.Trim(content, " \t\n\\") == "") && len(flags) == 0 {
+			return n.keyword(c) + "\n"
+		}
 	}
 
 	if jsonItems, ok := unmarshalJSONStringArray(content); ok {
-		content = marshalJSONStringArray(jsonItems) + "\n"
+		content = formatJSONArray(jsonItems, content, c) + "\n"
 	} else {
-		content = formatShell(content, hereDoc, c)
+		content = formatShell(content, hereDoc, shellConfig)
 		if hereDoc {
 			n.Heredocs[0].Content = content
 			content, _ = GetHeredoc(n)
 		}
 	}
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
 
-	return n.directive() + " " + prependFlags(flags, content, c)
+	return n.keyword(c) + " " + prependFlags(normalizeMountFlags(n, c), content, c)
+}
+
+// normalizeMountFlags returns the node's flags with every --mount value
+// normalized. Invalid mount specs are left as written; Lint reports them.
+func normalizeMountFlags(n *ExtendedNode, c *Config) []string {
+	if !c.Enabled(RuleNormalizeMounts) {
+		return n.Flags
+	}
+	flags := make([]string, len(n.Flags))
+	for i, flag := range n.Flags {
+		normalized, err := normalizeMountFlag(flag)
+		if err != nil {
+			normalized = flag
+		}
+		flags[i] = normalized
+	}
+	return flags
 }
 
 func GetHeredoc(n *ExtendedNode) (string, bool) {
@@ -479,7 +1021,10 @@ func GetHeredoc(n *ExtendedNode) (string, bool) {
 		}
 		cur = cur.Next
 	}
-	content := strings.Join(args, " ") + "\n" + n.Heredocs[0].Content + n.Heredocs[0].Name + "\n"
+	content := strings.Join(args, " ") + "\n"
+	for _, h := range n.Heredocs {
+		content += h.Content + h.Name + "\n"
+	}
 	return content, true
 }
 func formatBasic(n *ExtendedNode, c *Config) string {
@@ -487,11 +1032,11 @@ func formatBasic(n *ExtendedNode, c *Config) string {
 	if !success {
 		rawContent, ok := extractDirectiveContent(n, 0)
 		if !ok {
-			return n.directive() + "\n"
+			return n.keyword(c) + "\n"
 		}
 		value = strings.TrimLeft(rawContent, " \t")
 	}
-	return IndentFollowingLines(n.directive()+" "+value, c.IndentSize)
+	return indentFollowingLines(n.keyword(c)+" "+value, c.indent())
 }
 
 func getCmd(n *ExtendedNode, shouldSplitNode bool) []string {
@@ -505,7 +1050,8 @@ func getCmd(n *ExtendedNode, shouldSplitNode bool) []string {
 		if shouldSplitNode {
 			parts, err := shlex.Split(rawValue)
 			if err != nil {
-				log.Fatalf("Error splitting: %s\n", node.Value)
+				// Unbalanced quotes; keep the value as a single word
+				parts = []string{rawValue}
 			}
 			cmd = append(cmd, parts...)
 		} else {
@@ -520,8 +1066,8 @@ func formatCmd(n *ExtendedNode, c *Config) string {
 
 	flags := n.Flags
 	content, ok := extractDirectiveContent(n, len(flags))
-	if !ok && len(flags) > 0 {
-		return n.directive() + "\n"
+	if !ok || n.Next == nil {
+		return n.keyword(c) + "\n"
 	}
 
 	// If JSON form (attribute or decodable), format as JSON array with spaces
@@ -531,12 +1077,21 @@ func formatCmd(n *ExtendedNode, c *Config) string {
 		if !isJSON && len(items) == 0 {
 			items = jsonItems
 		}
-		return n.directive() + " " + marshalJSONStringArray(items) + "\n"
+		return n.keyword(c) + " " + formatJSONArray(items, content, c) + "\n"
 	}
 
 	// Otherwise, format as shell command
 	shell := formatShell(content, false, c)
-	return n.directive() + " " + prependFlags(flags, shell, c)
+	return n.keyword(c) + " " + prependFlags(flags, shell, c)
+}
+
+// formatJSONArray returns items as a re-spaced JSON array, or the original
+// text as written when the json-spacing rule is disabled.
+func formatJSONArray(items []string, original string, c *Config) string {
+	if !c.Enabled(RuleJSONSpacing) {
+		return strings.TrimSpace(original)
+	}
+	return marshalJSONStringArray(items)
 }
 
 // multilineMode controls how a space-separated directive that the author wrote
@@ -564,20 +1119,28 @@ func spaceSeparated(mode multilineMode) func(*ExtendedNode, *Config) string {
 		if !success {
 			argSep := " "
 			if mode == argsOnOwnLines && hasLineContinuation(n) {
-				argSep = " \\\n" + strings.Repeat(" ", int(c.IndentSize))
+				argSep = " \\\n" + c.indent()
 			}
 			content := strings.Join(getCmd(n.Next, isJSON), argSep)
-			flagsMultiline := mode == flagsOnOwnLines && (hasLineContinuation(n) || hasMountFlag(n.Flags))
+			if strings.HasPrefix(content, "--") {
+				// Keep the "--" that stops buildkit reading the argument as a flag
+				content = "-- " + content
+			}
+			flagsMultiline := mode == flagsOnOwnLines && (hasLineContinuation(n) || splitFlags(n.Flags, c))
 			cmd = prependFlagsImpl(n.Flags, content, c, flagsMultiline) + "\n"
 		}
 
-		return n.directive() + " " + cmd
+		return n.keyword(c) + " " + cmd
 	}
 }
 
 func formatMaintainer(n *ExtendedNode, c *Config) string {
-	maintainer := strings.Trim(n.Next.Value, "\"")
-	return "LABEL org.opencontainers.image.authors=\"" + maintainer + "\"\n"
+	// Docker rejects a LABEL before the first FROM, so a MAINTAINER there that
+	// relocateMaintainers didn't move is left alone.
+	if !c.Enabled(RuleMaintainerToLabel) || n.Next == nil || n.beforeFrom {
+		return formatBasic(n, c)
+	}
+	return matchKeywordCase(command.Label, n.keyword(c)) + " " + maintainerLabel(n.Next.Value) + "\n"
 }
 
 func GetFileLines(fileName string) ([]string, error) {
@@ -615,17 +1178,21 @@ func FormatComments(lines []string) string {
 
 // IndentFollowingLines re-indents all lines after the first to indentSize spaces.
 func IndentFollowingLines(lines string, indentSize uint) string {
+	return indentFollowingLines(lines, strings.Repeat(" ", int(indentSize)))
+}
+
+func indentFollowingLines(lines string, indent string) string {
 	allLines := strings.SplitAfter(lines, "\n")
 	if len(allLines) <= 1 {
 		return lines
 	}
 
-	indent := strings.Repeat(" ", int(indentSize))
 	var b strings.Builder
 	b.Grow(len(lines) + len(indent)*len(allLines))
 	b.WriteString(allLines[0])
-	for _, line := range allLines[1:] {
-		if line != "" {
+	for i, line := range allLines[1:] {
+		// A line that continues a word from the previous one can't be indented.
+		if line != "" && !continuesWord(allLines[i], line) {
 			line = indent + strings.TrimLeft(line, " \t")
 		}
 		b.WriteString(line)
@@ -633,20 +1200,37 @@ func IndentFollowingLines(lines string, indentSize uint) string {
 	return b.String()
 }
 
-func formatBash(s string, c *Config) string {
+// continuesWord reports whether line ends with a line continuation straight
+// after a word and next starts without whitespace, so buildkit joins the two
+// into one word.
+func continuesWord(line, next string) bool {
+	rest, ok := strings.CutSuffix(line, "\\\n")
+	if !ok || rest == "" || next == "" {
+		return false
+	}
+	last := len(rest) - 1
+	escaped := last > 0 && rest[last-1] == '\\'
+	return (escaped || !strings.ContainsRune(" \t", rune(rest[last]))) && !strings.ContainsRune(" \t", rune(next[0]))
+}
+
+func formatBash(s string, c *Config) (string, error) {
 	r := strings.NewReader(s)
 	f, err := syntax.NewParser(syntax.KeepComments(true)).Parse(r, "")
 	if err != nil {
-		fmt.Printf("Error parsing: %s\n", s)
-		panic(err)
+		return "", err
+	}
+	// shfmt indents with tabs when the indent size is 0
+	indentSize := c.IndentSize
+	if c.UseTabs {
+		indentSize = 0
 	}
 	buf := new(bytes.Buffer)
-	syntax.NewPrinter(
+	err = syntax.NewPrinter(
 		syntax.Minify(false),
 		syntax.SingleLine(false),
 		syntax.SpaceRedirects(c.SpaceRedirects),
-		syntax.Indent(c.IndentSize),
+		syntax.Indent(indentSize),
 		syntax.BinaryNextLine(true),
 	).Print(buf, f)
-	return buf.String()
+	return buf.String(), err
 }
@@ -1,8 +1,14 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/stretchr/testify/assert"
@@ -152,6 +158,46 @@ func TestUnmarshalJSONStringArray(t *testing.T) {
 	}
 }
 
+// --- normalizeMountFlag ---
+
+func TestNormalizeMountFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"non-mount flag unchanged", "--network=host", "--network=host", true},
+		{"already canonical", "--mount=type=cache,target=/root/.cache", "--mount=type=cache,target=/root/.cache", true},
+		{"keys reordered", "--mount=target=/root/.cache,sharing=locked,id=x,type=cache", "--mount=type=cache,id=x,target=/root/.cache,sharing=locked", true},
+		{"dst alias", "--mount=type=bind,dst=/app", "--mount=type=bind,target=/app", true},
+		{"destination alias", "--mount=type=bind,destination=/app", "--mount=type=bind,target=/app", true},
+		{"src alias", "--mount=type=bind,src=.,target=/app", "--mount=type=bind,source=.,target=/app", true},
+		{"bare ro alias", "--mount=type=bind,ro,target=/app", "--mount=type=bind,target=/app,readonly", true},
+		{"ro with value", "--mount=type=bind,target=/app,ro=true", "--mount=type=bind,target=/app,readonly=true", true},
+		{"uppercase key", "--mount=TYPE=cache,target=/x", "--mount=type=cache,target=/x", true},
+		{"quoted field", `--mount=type=bind,"source=a,b",target=/x`, `--mount=type=bind,"source=a,b",target=/x`, true},
+		{"unknown key", "--mount=type=cache,foo=bar", "", false},
+		{"missing value", "--mount=type=cache,target", "", false},
+		{"unknown type", "--mount=type=volume,target=/x", "", false},
+		{"duplicate key unchanged", "--mount=type=bind,src=a,source=b", "--mount=type=bind,src=a,source=b", true},
+		{"conflicting keys unchanged", "--mount=type=bind,rw,ro", "--mount=type=bind,rw,ro", true},
+		{"variable unchanged", "--mount=type=$T,target=/x", "--mount=type=$T,target=/x", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := normalizeMountFlag(tt.input)
+			if !tt.ok {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
 // --- formatBash ---
 
 func TestFormatBash(t *testing.T) {
@@ -195,7 +241,8 @@ func TestFormatBash(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := formatBash(tt.input, tt.config)
+			result, err := formatBash(tt.input, tt.config)
+			require.NoError(t, err)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
@@ -246,6 +293,20 @@ func TestFormatShell(t *testing.T) {
 			&Config{IndentSize: 4, SpaceRedirects: true},
 			"echo foo >> bar\n",
 		},
+		{
+			"invalid shell passes through",
+			"echo $(foo",
+			false,
+			defaultConfig,
+			"echo $(foo",
+		},
+		{
+			"trailing continuation is dropped",
+			"echo hi \\",
+			false,
+			defaultConfig,
+			"echo hi\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -313,6 +374,27 @@ func TestConfigVariations(t *testing.T) {
 			"",
 			"FROM alpine\nRUN echo a \\\n        && echo b\n",
 		},
+		{
+			"tabs",
+			"FROM alpine\nRUN echo a \\\n  && echo b\nENV A=1 \\\n  B=2\nLABEL a=b \\\n  c=d\n",
+			&Config{IndentSize: 4, UseTabs: true, TrailingNewline: true},
+			"",
+			"FROM alpine\nRUN echo a \\\n\t&& echo b\nENV A=1 \\\n\tB=2\nLABEL a=b \\\n\tc=d\n",
+		},
+		{
+			"tabs in shell blocks",
+			"FROM alpine\nRUN <<EOF\nif true\nthen\necho hi\nfi\nEOF\n",
+			&Config{IndentSize: 4, UseTabs: true, TrailingNewline: true},
+			"",
+			"FROM alpine\nRUN <<EOF\nif true; then\n\techo hi\nfi\nEOF\n",
+		},
+		{
+			"<<- heredoc keeps tabs",
+			"FROM alpine\nRUN <<-EOF\n\tif true\n\tthen\n\t\techo hi\n\tfi\nEOF\n",
+			&Config{IndentSize: 4, TrailingNewline: true},
+			"",
+			"FROM alpine\nRUN <<-EOF\nif true; then\n\techo hi\nfi\nEOF\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -328,6 +410,432 @@ func TestConfigVariations(t *testing.T) {
 	}
 }
 
+// --- Line endings and byte order marks ---
+
+func TestLineEndings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		config   *Config
+		expected string
+	}{
+		{"lf kept", "from a\nrun echo hi\n", &Config{TrailingNewline: true}, "FROM a\nRUN echo hi\n"},
+		{"crlf kept", "from a\r\nrun echo a && \\\r\n  echo b\r\n", &Config{IndentSize: 4, TrailingNewline: true}, "FROM a\r\nRUN echo a \\\r\n    && echo b\r\n"},
+		{"mixed follows first line", "from a\r\nrun echo hi\n", &Config{TrailingNewline: true}, "FROM a\r\nRUN echo hi\r\n"},
+		{"forced lf", "from a\r\nrun echo hi\r\n", &Config{TrailingNewline: true, LineEnding: LineEndingLF}, "FROM a\nRUN echo hi\n"},
+		{"forced crlf", "from a\nrun echo hi\n", &Config{TrailingNewline: true, LineEnding: LineEndingCRLF}, "FROM a\r\nRUN echo hi\r\n"},
+		{"crlf heredoc", "FROM a\r\nRUN <<EOF\r\necho hi\r\nEOF\r\n", &Config{TrailingNewline: true}, "FROM a\r\nRUN <<EOF\r\necho hi\r\nEOF\r\n"},
+		{"cr at end of input", "from a\r\nrun echo hi\r", &Config{TrailingNewline: true}, "FROM a\r\nRUN echo hi\r\n"},
+		{"stray crs dropped", "from a\nrun echo hi\r\r\n", &Config{TrailingNewline: true}, "FROM a\nRUN echo hi\n"},
+		{"bom kept", "\ufefffrom a\n", &Config{TrailingNewline: true}, "\ufeffFROM a\n"},
+		{"bom stripped", "\ufefffrom a\n", &Config{TrailingNewline: true, StripBOM: true}, "FROM a\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := NewFormatter(tt.config).FormatBytes([]byte(tt.input))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(out))
+		})
+	}
+}
+
+// --- Line ranges ---
+
+func TestLineRanges(t *testing.T) {
+	input := "from a\nrun   echo 1\n\n\n\n#   note\nrun echo 2 &&   echo 3\nmaintainer me\n"
+	tests := []struct {
+		name     string
+		ranges   []LineRange
+		expected string
+	}{
+		{"all", nil, "FROM a\nRUN echo 1\n\n#   note\nRUN echo 2 && echo 3\nLABEL org.opencontainers.image.authors=\"me\"\n"},
+		{"one directive", []LineRange{{2, 2}}, "from a\nRUN echo 1\n\n\n\n#   note\nrun echo 2 &&   echo 3\nmaintainer me\n"},
+		{"gap and directive", []LineRange{{4, 7}}, "from a\nrun   echo 1\n\n#   note\nRUN echo 2 && echo 3\nmaintainer me\n"},
+		{"maintainer converted in place", []LineRange{{8, 8}}, "from a\nrun   echo 1\n\n\n\n#   note\nrun echo 2 &&   echo 3\nLABEL org.opencontainers.image.authors=\"me\"\n"},
+		{"no overlap", []LineRange{{20, 30}}, input},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{IndentSize: 4, TrailingNewline: true, LineRanges: tt.ranges}
+			assert.Equal(t, tt.expected, formatDockerfile(input, c))
+		})
+	}
+
+	t.Run("maintainer before from kept", func(t *testing.T) {
+		c := &Config{IndentSize: 4, TrailingNewline: true, LineRanges: []LineRange{{1, 1}}}
+		assert.Equal(t, "MAINTAINER me\nfrom a\n", formatDockerfile("maintainer   me\nfrom a\n", c))
+	})
+}
+
+// --- FormatFileLines: blank-line policy ---
+
+func uintPtr(n uint) *uint {
+	return &n
+}
+
+func TestBlankLinePolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		config   *Config
+		expected string
+	}{
+		{
+			"default keeps two blank lines",
+			"FROM alpine\n\n\nRUN ls\n",
+			defaultConfig,
+			"FROM alpine\n\n\nRUN ls\n",
+		},
+		{
+			"max blank lines 1",
+			"FROM alpine\n\n\nRUN ls\n",
+			&Config{IndentSize: 4, TrailingNewline: true, MaxBlankLines: uintPtr(1)},
+			"FROM alpine\n\nRUN ls\n",
+		},
+		{
+			"max blank lines keeps blank lines between comments",
+			"FROM alpine\n# a\n\n\n\n# b\nRUN ls\n",
+			&Config{IndentSize: 4, TrailingNewline: true, MaxBlankLines: uintPtr(2)},
+			"FROM alpine\n# a\n\n\n# b\nRUN ls\n",
+		},
+		{
+			"max blank lines 0",
+			"FROM alpine\n\nRUN ls\n\n\n# note\nRUN ls\n",
+			&Config{IndentSize: 4, TrailingNewline: true, MaxBlankLines: uintPtr(0)},
+			"FROM alpine\nRUN ls\n# note\nRUN ls\n",
+		},
+		{
+			"blank line before stage inserted",
+			"FROM alpine\nRUN ls\n# final\nFROM scratch\n",
+			&Config{IndentSize: 4, TrailingNewline: true, BlankLineBeforeStage: true},
+			"FROM alpine\nRUN ls\n\n# final\nFROM scratch\n",
+		},
+		{
+			"blank line before first stage not required",
+			"ARG V=1\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, BlankLineBeforeStage: true},
+			"ARG V=1\nFROM alpine\n",
+		},
+		{
+			"grouped directives",
+			"FROM alpine\nENV A=1\n\nENV B=2\n\nARG C\n\nARG D\n",
+			&Config{IndentSize: 4, TrailingNewline: true, GroupDirectives: []string{"env"}},
+			"FROM alpine\nENV A=1\nENV B=2\n\nARG C\n\nARG D\n",
+		},
+		{
+			"leading blank lines trimmed after parser directives",
+			"# syntax=docker/dockerfile:1\n\n# comment\n\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, TrimLeadingBlankLines: true},
+			"# syntax=docker/dockerfile:1\n# comment\n\nFROM alpine\n",
+		},
+		{
+			"leading blank lines trimmed",
+			"\n\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, TrimLeadingBlankLines: true},
+			"FROM alpine\n",
+		},
+		{
+			"blank line kept before a comment that looks like a directive",
+			"# syntax=docker/dockerfile:1\n\n\n# escape=`\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, TrimLeadingBlankLines: true},
+			"# syntax=docker/dockerfile:1\n\n# escape=`\nFROM alpine\n",
+		},
+		{
+			"blank line kept before a directive-like comment by default",
+			"# syntax=docker/dockerfile:1\n\n\n# escape=`\nFROM alpine\n",
+			defaultConfig,
+			"# syntax=docker/dockerfile:1\n\n# escape=`\nFROM alpine\n",
+		},
+		{
+			"blank line kept before a leading comment that looks like a directive",
+			"\n\n# escape=`\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, TrimLeadingBlankLines: true},
+			"\n# escape=`\nFROM alpine\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatDockerfile(tt.input, tt.config)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+// --- Comment normalization ---
+
+func TestEnsureCommentSpace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"#foo\n", "# foo\n"},
+		{"# foo\n", "# foo\n"},
+		{"#\tfoo\n", "#\tfoo\n"},
+		{"#\n", "#\n"},
+		{"#!/bin/sh\n", "#!/bin/sh\n"},
+		{"####\n", "####\n"},
+		{"not a comment\n", "not a comment\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ensureCommentSpace(tt.input))
+		})
+	}
+}
+
+func TestCommentNormalization(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		config   *Config
+		expected string
+	}{
+		{
+			"disabled by default",
+			"#foo\nFROM alpine\n",
+			defaultConfig,
+			"#foo\nFROM alpine\n",
+		},
+		{
+			"space added",
+			"#foo\nFROM alpine\n#bar\n",
+			&Config{IndentSize: 4, TrailingNewline: true, CommentSpace: true},
+			"# foo\nFROM alpine\n# bar\n",
+		},
+		{
+			"parser directives untouched",
+			"#syntax=docker/dockerfile:1\n#escape=\\\n#foo\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, CommentSpace: true},
+			"#syntax=docker/dockerfile:1\n#escape=\\\n# foo\nFROM alpine\n",
+		},
+		{
+			"directive-like comment after FROM is a comment",
+			"FROM alpine\n#syntax=foo\n",
+			&Config{IndentSize: 4, TrailingNewline: true, CommentSpace: true},
+			"FROM alpine\n# syntax=foo\n",
+		},
+		{
+			"comment inside RUN continuation",
+			"FROM alpine\nRUN echo a \\\n    #note\n    && echo b\n",
+			&Config{IndentSize: 4, TrailingNewline: true, CommentSpace: true},
+			"FROM alpine\nRUN echo a \\\n    # note\n    && echo b\n",
+		},
+		{
+			"long paragraph reflowed",
+			"# one two three four five six\n# seven\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, ReflowComments: true, LineWidth: 16},
+			"# one two three\n# four five six\n# seven\nFROM alpine\n",
+		},
+		{
+			"short paragraph kept",
+			"# one\n# two\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, ReflowComments: true, LineWidth: 16},
+			"# one\n# two\nFROM alpine\n",
+		},
+		{
+			"list items not reflowed",
+			"# - one two three four five six\n# - seven\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, ReflowComments: true, LineWidth: 16},
+			"# - one two three four five six\n# - seven\nFROM alpine\n",
+		},
+		{
+			"parser directive not merged into paragraph",
+			"# syntax=docker/dockerfile:1\n# one two three four five six\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, ReflowComments: true, LineWidth: 16},
+			"# syntax=docker/dockerfile:1\n# one two three\n# four five six\nFROM alpine\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatDockerfile(tt.input, tt.config)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+// --- MAINTAINER upgrade ---
+
+func TestMaintainerUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		config   *Config
+		expected string
+	}{
+		{
+			"before FROM moved after it",
+			"MAINTAINER me\n\nFROM alpine\nRUN ls\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"me\"\nRUN ls\n",
+		},
+		{
+			"merged into existing LABEL",
+			"FROM alpine\nLABEL version=\"1.0\"\nMAINTAINER me\n",
+			defaultConfig,
+			"FROM alpine\nLABEL version=\"1.0\" org.opencontainers.image.authors=\"me\"\n",
+		},
+		{
+			"before FROM merged into LABEL of first stage",
+			"MAINTAINER me\nFROM alpine\nLABEL a=b\nFROM scratch\nLABEL c=d\n",
+			defaultConfig,
+			"FROM alpine\nLABEL a=b org.opencontainers.image.authors=\"me\"\nFROM scratch\nLABEL c=d\n",
+		},
+		{
+			"merged into multiline LABEL",
+			"FROM alpine\nLABEL a=b \\\n  c=d\nMAINTAINER me\n",
+			defaultConfig,
+			"FROM alpine\nLABEL a=b \\\n    c=d \\\n    org.opencontainers.image.authors=\"me\"\n",
+		},
+		{
+			"merged into the nearest LABEL",
+			"FROM alpine\nLABEL a=b\nLABEL org.opencontainers.image.authors=z\nMAINTAINER me\n",
+			defaultConfig,
+			"FROM alpine\nLABEL a=b\nLABEL org.opencontainers.image.authors=z org.opencontainers.image.authors=\"me\"\n",
+		},
+		{
+			"not merged into a later LABEL setting the authors",
+			"FROM alpine\nMAINTAINER me\nLABEL \"org.opencontainers.image.authors\"=z\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"me\"\nLABEL \"org.opencontainers.image.authors\"=z\n",
+		},
+		{
+			"not merged past a LABEL setting the authors",
+			"FROM alpine\nLABEL a=b\n# dockerfmt-ignore\nLABEL org.opencontainers.image.authors=z\nMAINTAINER me\n",
+			defaultConfig,
+			"FROM alpine\nLABEL a=b\n# dockerfmt-ignore\nLABEL org.opencontainers.image.authors=z\nLABEL org.opencontainers.image.authors=\"me\"\n",
+		},
+		{
+			"before FROM not merged into a LABEL setting the authors",
+			"MAINTAINER me\nFROM alpine\nLABEL org.opencontainers.image.authors=z\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"me\"\nLABEL org.opencontainers.image.authors=z\n",
+		},
+		{
+			"embedded quotes escaped",
+			"FROM alpine\nMAINTAINER \"Jane\" <j@x.com>\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"\\\"Jane\\\" <j@x.com>\"\n",
+		},
+		{
+			"surrounding quotes removed",
+			"FROM alpine\nMAINTAINER \"Jane Doe\"\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"Jane Doe\"\n",
+		},
+		{
+			"dollar escaped",
+			"FROM alpine\nMAINTAINER $USER\n",
+			defaultConfig,
+			"FROM alpine\nLABEL org.opencontainers.image.authors=\"\\$USER\"\n",
+		},
+		{
+			"keep maintainer",
+			"MAINTAINER  me\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, Rules: map[string]bool{RuleMaintainerToLabel: false}},
+			"MAINTAINER me\nFROM alpine\n",
+		},
+		{
+			"deprecated KeepMaintainer",
+			"MAINTAINER  me\nFROM alpine\n",
+			&Config{IndentSize: 4, TrailingNewline: true, KeepMaintainer: true},
+			"MAINTAINER me\nFROM alpine\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatDockerfile(tt.input, tt.config)
+			assert.Equal(t, tt.expected, result)
+			assert.NoError(t, NewFormatter(tt.config).Verify(tt.input, result))
+		})
+	}
+}
+
+// --- Rules ---
+
+func TestRuleDefaults(t *testing.T) {
+	c := &Config{}
+	for _, r := range Rules {
+		assert.Equal(t, r.Default, c.Enabled(r.Name), r.Name)
+	}
+	c.Rules = map[string]bool{RuleJSONSpacing: false}
+	assert.False(t, c.Enabled(RuleJSONSpacing))
+	assert.True(t, c.Enabled(RuleEnvKeyValue))
+}
+
+func TestDisabledRules(t *testing.T) {
+	disable := func(rule string) *Config {
+		return &Config{IndentSize: 4, TrailingNewline: true, Rules: map[string]bool{rule: false}}
+	}
+	tests := []struct {
+		name     string
+		input    string
+		config   *Config
+		expected string
+	}{
+		{
+			RuleUppercaseDirectives,
+			"from alpine\nRun echo hi\n",
+			disable(RuleUppercaseDirectives),
+			"from alpine\nRun echo hi\n",
+		},
+		{
+			RuleEnvKeyValue,
+			"FROM alpine\nENV MY_VAR my-value\n",
+			disable(RuleEnvKeyValue),
+			"FROM alpine\nENV MY_VAR my-value\n",
+		},
+		{
+			RuleJSONSpacing,
+			"FROM alpine\nCMD [\"ls\",\"-la\"]\nRUN [\"echo\",\"hi\"]\n",
+			disable(RuleJSONSpacing),
+			"FROM alpine\nCMD [\"ls\",\"-la\"]\nRUN [\"echo\",\"hi\"]\n",
+		},
+		{
+			RuleSplitMountFlags,
+			"FROM alpine\nRUN --mount=type=cache,target=/c make\n",
+			disable(RuleSplitMountFlags),
+			"FROM alpine\nRUN --mount=type=cache,target=/c make\n",
+		},
+		{
+			RuleNormalizeMounts,
+			"FROM alpine\nRUN --mount=dst=/c,type=cache make\n",
+			disable(RuleNormalizeMounts),
+			"FROM alpine\nRUN --mount=dst=/c,type=cache \\\n    make\n",
+		},
+		{
+			RuleFromAsCasing,
+			"FROM alpine as base\n",
+			disable(RuleFromAsCasing),
+			"FROM alpine as base\n",
+		},
+		{
+			RuleStageNameCasing,
+			"FROM alpine AS Base\nFROM Base\n",
+			disable(RuleStageNameCasing),
+			"FROM alpine AS Base\nFROM Base\n",
+		},
+		{
+			RulePlatformCasing,
+			"FROM --platform=Linux/AMD64 alpine\n",
+			disable(RulePlatformCasing),
+			"FROM --platform=Linux/AMD64 alpine\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatDockerfile(tt.input, tt.config)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
 // --- FormatFileLines: Per-directive tests ---
 
 func TestPerDirective(t *testing.T) {
@@ -386,6 +894,16 @@ func TestPerDirective(t *testing.T) {
 			"FROM alpine\nRUN --network=host echo hello\n",
 			"FROM alpine\nRUN --network=host echo hello\n",
 		},
+		{
+			"RUN mount normalized",
+			"FROM alpine\nRUN --mount=target=/root/.cache,id=x,sharing=locked,type=cache pip install .\n",
+			"FROM alpine\nRUN --mount=type=cache,id=x,target=/root/.cache,sharing=locked \\\n    pip install .\n",
+		},
+		{
+			"RUN invalid mount left unchanged",
+			"FROM alpine\nRUN --mount=type=cache,bogus=1 pip install .\n",
+			"FROM alpine\nRUN --mount=type=cache,bogus=1 \\\n    pip install .\n",
+		},
 		{
 			"COPY normalizes whitespace",
 			"FROM alpine\nCOPY  .   /app\n",
@@ -451,6 +969,64 @@ func TestPerDirective(t *testing.T) {
 	}
 }
 
+// --- Stage names ---
+
+func TestStageNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"AS uppercased",
+			"FROM alpine as build\n",
+			"FROM alpine AS build\n",
+		},
+		{
+			"stage name lowercased",
+			"FROM alpine AS Build\n",
+			"FROM alpine AS build\n",
+		},
+		{
+			"COPY --from reference renamed",
+			"FROM alpine AS Build\nFROM scratch\nCOPY --from=Build /a /a\n",
+			"FROM alpine AS build\nFROM scratch\nCOPY --from=build /a /a\n",
+		},
+		{
+			"COPY --from image left alone",
+			"FROM alpine AS build\nCOPY --from=Nginx:Latest /a /a\n",
+			"FROM alpine AS build\nCOPY --from=Nginx:Latest /a /a\n",
+		},
+		{
+			"FROM stage reference renamed",
+			"FROM alpine AS Base\nFROM BASE\n",
+			"FROM alpine AS base\nFROM base\n",
+		},
+		{
+			"RUN mount from renamed",
+			"FROM alpine AS Deps\nFROM scratch\nRUN --mount=from=Deps,target=/d ls /d\n",
+			"FROM alpine AS deps\nFROM scratch\nRUN --mount=from=deps,target=/d \\\n    ls /d\n",
+		},
+		{
+			"platform lowercased",
+			"FROM --platform=Linux/ARM64 alpine\n",
+			"FROM --platform=linux/arm64 alpine\n",
+		},
+		{
+			"platform variable untouched",
+			"FROM --platform=$BUILDPLATFORM alpine\n",
+			"FROM --platform=$BUILDPLATFORM alpine\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatDockerfile(tt.input, defaultConfig)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
 // --- BuildExtendedNode ---
 
 func TestBuildExtendedNode(t *testing.T) {
@@ -540,6 +1116,555 @@ func TestGetFileLines(t *testing.T) {
 	})
 }
 
+// --- Formatter registry ---
+
+func TestFormatterRegistry(t *testing.T) {
+	input := strings.SplitAfter("FROM alpine\nLABEL a=b\nRUN echo hi\nONBUILD LABEL c=d\n", "\n")
+
+	t.Run("register replaces directive formatter", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		f.Register("LABEL", func(n *ExtendedNode, c *Config) string {
+			return "LABEL custom\n"
+		})
+		assert.Equal(t, "FROM alpine\nLABEL custom\nRUN echo hi\nONBUILD LABEL custom\n", f.FormatFileLines(input))
+	})
+
+	t.Run("wrap delegates to default", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		f.Wrap("run", func(next DirectiveFormatter) DirectiveFormatter {
+			return func(n *ExtendedNode, c *Config) string {
+				return "# run\n" + next(n, c)
+			}
+		})
+		assert.Equal(t, "FROM alpine\nLABEL a=b\n# run\nRUN echo hi\nONBUILD LABEL c=d\n", f.FormatFileLines(input))
+	})
+
+	t.Run("instances are independent", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		f.Register("label", func(n *ExtendedNode, c *Config) string { return "LABEL x\n" })
+		assert.Equal(t, "FROM alpine\nLABEL a=b\nRUN echo hi\nONBUILD LABEL c=d\n", NewFormatter(defaultConfig).FormatFileLines(input))
+		assert.NotNil(t, DefaultFormatters()["label"])
+	})
+
+	t.Run("hooks", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		var seen []string
+		f.AddPreHook(func(n *ExtendedNode, c *Config) {
+			seen = append(seen, n.Value)
+		})
+		f.AddPostHook(func(n *ExtendedNode, c *Config, output string) string {
+			return strings.ToLower(output)
+		})
+		assert.Equal(t, "from alpine\nlabel a=b\nrun echo hi\nonbuild label c=d\n", f.FormatFileLines(input))
+		assert.Equal(t, []string{"FROM", "LABEL", "RUN", "ONBUILD", "LABEL"}, seen)
+	})
+}
+
+func TestFormatterFormat(t *testing.T) {
+	input := "from alpine\nrun echo a &&   echo b\n"
+	expected := "FROM alpine\nRUN echo a && echo b\n"
+	f := NewFormatter(defaultConfig)
+
+	t.Run("bytes", func(t *testing.T) {
+		out, err := f.FormatBytes([]byte(input))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(out))
+	})
+
+	t.Run("reader and writer", func(t *testing.T) {
+		var out strings.Builder
+		require.NoError(t, f.Format(context.Background(), strings.NewReader(input), &out))
+		assert.Equal(t, expected, out.String())
+	})
+
+	t.Run("matches FormatFileLines", func(t *testing.T) {
+		for _, in := range []string{input, strings.TrimSuffix(input, "\n"), input + "\n# trailing\n\n"} {
+			out, err := f.FormatBytes([]byte(in))
+			require.NoError(t, err)
+			assert.Equal(t, f.FormatFileLines(strings.SplitAfter(in, "\n")), string(out))
+		}
+	})
+
+	t.Run("parse error", func(t *testing.T) {
+		_, err := f.FormatBytes([]byte("FROM alpine\nRUN <<EOF\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var out strings.Builder
+		err := f.Format(ctx, strings.NewReader(input), &out)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Empty(t, out.String())
+	})
+}
+
+// --- Verification ---
+
+func TestCompareInstructions(t *testing.T) {
+	tests := []struct {
+		name      string
+		original  string
+		formatted string
+		ok        bool
+	}{
+		{"identical", "FROM alpine\nRUN ls\n", "FROM alpine\nRUN ls\n", true},
+		{"shell layout ignored", "FROM alpine\nRUN echo a &&   echo b\n", "FROM alpine\nRUN echo a \\\n    && echo b\n", true},
+		{"shell comments ignored", "FROM alpine\nRUN echo a \\\n  # note\n  && echo b\n", "FROM alpine\nRUN echo a && echo b\n", true},
+		{"json spacing ignored", "FROM alpine\nCMD [\"a\",\"b\"]\n", "FROM alpine\nCMD [\"a\", \"b\"]\n", true},
+		{"legacy env", "FROM alpine\nENV A b\n", "FROM alpine\nENV A=b\n", true},
+		{"stage renamed", "FROM alpine AS Build\nFROM scratch\nCOPY --from=Build /a /a\n", "FROM alpine AS build\nFROM scratch\nCOPY --from=build /a /a\n", true},
+		{"mount normalized", "FROM alpine\nRUN --mount=dst=/c,type=cache ls\n", "FROM alpine\nRUN --mount=type=cache,target=/c ls\n", true},
+		{"maintainer moved", "MAINTAINER me\nFROM alpine\n", "FROM alpine\nLABEL org.opencontainers.image.authors=\"me\"\n", true},
+		{"maintainer merged", "FROM alpine\nLABEL a=b\nMAINTAINER me\n", "FROM alpine\nLABEL a=b org.opencontainers.image.authors=\"me\"\n", true},
+		{"heredoc reformatted", "FROM alpine\nRUN <<EOF\nif true; then\necho hi\nfi\nEOF\n", "FROM alpine\nRUN <<EOF\nif true; then\n    echo hi\nfi\nEOF\n", true},
+		{"command changed", "FROM alpine\nRUN echo a\n", "FROM alpine\nRUN echo b\n", false},
+		{"instruction missing", "FROM alpine\nRUN ls\nRUN pwd\n", "FROM alpine\nRUN ls\n", false},
+		{"env value changed", "FROM alpine\nENV A=\"x  y\"\n", "FROM alpine\nENV A=\"x y\"\n", false},
+		{"flag changed", "FROM alpine\nCOPY --chmod=644 a b\n", "FROM alpine\nCOPY --chmod=755 a b\n", false},
+		{"label changed", "FROM alpine\nLABEL a=b\n", "FROM alpine\nLABEL a=c\n", false},
+		{"variable changed", "FROM alpine\nLABEL a=$X\n", "FROM alpine\nLABEL a=$Y\n", false},
+		{"heredoc changed", "FROM alpine\nRUN <<EOF\necho a\nEOF\n", "FROM alpine\nRUN <<EOF\necho b\nEOF\n", false},
+		{"bash script heredoc reformatted", "FROM alpine\nRUN <<EOF\n#!/usr/bin/env bash\necho  hi\nEOF\n", "FROM alpine\nRUN <<EOF\n#!/usr/bin/env bash\necho hi\nEOF\n", true},
+		{"heredoc input of sh reformatted", "FROM alpine\nRUN sh -e <<EOF\necho  hi\nEOF\n", "FROM alpine\nRUN sh -e <<EOF\necho hi\nEOF\n", true},
+		{"python script heredoc changed", "FROM alpine\nRUN <<EOF\n#!/usr/bin/python3\nx  = 1\nEOF\n", "FROM alpine\nRUN <<EOF\n#!/usr/bin/python3\nx = 1\nEOF\n", false},
+		{"heredoc input of cat changed", "FROM alpine\nRUN cat <<EOF >/etc/motd\necho  hi\nEOF\n", "FROM alpine\nRUN cat <<EOF >/etc/motd\necho hi\nEOF\n", false},
+		{"legacy env of several words", "FROM alpine\nENV A b  c\n", "FROM alpine\nENV A=\"b  c\"\n", true},
+		{"env continuation reindented", "FROM alpine\nENV A=\"\\\n        x \\\n        y\"\n", "FROM alpine\nENV A=\"\\\n    x \\\n    y\"\n", true},
+		{"arg quoted", "FROM alpine\nARG A=b\n", "FROM alpine\nARG A=\"b\"\n", true},
+		{"arg changed", "FROM alpine\nARG A=b\n", "FROM alpine\nARG A=c\n", false},
+		{"labs flags", "FROM alpine\nCOPY --parents --exclude=*.md a /b/\n", "FROM alpine\nCOPY --parents --exclude=\"*.md\" a /b/\n", true},
+		{"labs flag changed", "FROM alpine\nCOPY --exclude=*.md a /b/\n", "FROM alpine\nCOPY --exclude=*.txt a /b/\n", false},
+		{"fragment", "run echo a &&   echo b\n", "RUN echo a && echo b\n", true},
+		{"fragment changed", "RUN echo a\n", "RUN echo b\n", false},
+		{"unknown directive", "FROM alpine\nfoo  bar\n", "FROM alpine\nFOO bar\n", true},
+		{"unknown directive changed", "FROM alpine\nFOO bar\n", "FROM alpine\nFOO baz\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CompareInstructions(tt.original, tt.formatted)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	t.Run("reports divergent line", func(t *testing.T) {
+		err := CompareInstructions("FROM alpine\nRUN ls\nRUN echo a\n", "FROM alpine\nRUN ls\nRUN echo b\n")
+		var verr *VerifyError
+		require.ErrorAs(t, err, &verr)
+		assert.Equal(t, 3, verr.Line)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	input := "FROM alpine\nRUN echo a &&   echo b\n"
+
+	t.Run("formatted output verifies", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		assert.NoError(t, f.Verify(input, f.FormatFileLines(strings.SplitAfter(input, "\n"))))
+	})
+
+	t.Run("non-idempotent formatter fails", func(t *testing.T) {
+		f := NewFormatter(defaultConfig)
+		f.AddPostHook(func(n *ExtendedNode, c *Config, output string) string {
+			return "# again\n" + output
+		})
+		err := f.Verify(input, f.FormatFileLines(strings.SplitAfter(input, "\n")))
+		assert.ErrorContains(t, err, "idempotent")
+	})
+}
+
+func TestVerifyEmbedded(t *testing.T) {
+	input := "```dockerfile\nfrom a\nrun echo a &&   echo b\n```\n\n```dockerfile\nFROM a\n```\n"
+
+	f := NewFormatter(defaultConfig)
+	_, blocks := f.FormatMarkdown([]byte(input))
+	require.Len(t, blocks, 2)
+	for _, b := range blocks {
+		assert.NoError(t, f.VerifyEmbedded(b))
+	}
+
+	f.AddPostHook(func(n *ExtendedNode, c *Config, output string) string {
+		return strings.Replace(output, "echo b", "echo c", 1)
+	})
+	_, blocks = f.FormatMarkdown([]byte(input))
+	assert.ErrorContains(t, f.VerifyEmbedded(blocks[0]), "instruction differs")
+	// An unchanged block has nothing to verify.
+	assert.NoError(t, f.VerifyEmbedded(blocks[1]))
+}
+
+// --- Lint and Diff ---
+
+func TestLint(t *testing.T) {
+	diagnostics, err := Lint([]byte("FROM alpine AS Build\nMAINTAINER me\nRUN a \\\n\n  b\nRUN --mount=type=cache,bogus=1 ls\n"))
+	require.NoError(t, err)
+	var got []string
+	for _, d := range diagnostics {
+		got = append(got, fmt.Sprintf("%d %s", d.Line, d.Rule))
+	}
+	assert.Equal(t, []string{"1 StageNameCasing", "2 MaintainerDeprecated", "5 ", "6 InvalidMount"}, got)
+
+	_, err = Lint([]byte("FROM alpine\nRUN <<EOF\n"))
+	assert.Error(t, err)
+	assert.Equal(t, 2, ErrorLine(err))
+	assert.Equal(t, 0, ErrorLine(context.Canceled))
+}
+
+func TestDiff(t *testing.T) {
+	assert.Equal(t, "", Diff("Dockerfile", "FROM a\n", "FROM a\n"))
+	assert.Equal(t, "--- Dockerfile\n+++ Dockerfile\n@@ -1,2 +1,2 @@\n FROM a\n-run b\n\\ No newline at end of file\n+RUN b\n",
+		Diff("Dockerfile", "FROM a\nrun b", "FROM a\nRUN b\n"))
+}
+
+// --- AST export ---
+
+func TestParseAST(t *testing.T) {
+	input := "FROM alpine\nRUN --network=none echo hi && \\\n  ls\nCMD [\"a\"]\nONBUILD RUN x\nRUN <<EOF\necho $(\nEOF\n"
+	ast, err := ParseAST([]byte(input), ASTOptions{Shell: true})
+	require.NoError(t, err)
+	require.Len(t, ast.Children, 5)
+	assert.Empty(t, ast.Original)
+
+	run := ast.Children[1]
+	assert.Equal(t, "RUN", run.Directive)
+	assert.Equal(t, []string{"--network=none"}, run.Flags)
+	assert.Equal(t, []string{"echo hi &&   ls"}, run.Args)
+	assert.Equal(t, 2, run.StartLine)
+	assert.Equal(t, 3, run.EndLine)
+	assert.Equal(t, "RUN --network=none echo hi && \\\n  ls\n", run.Original)
+	assert.Contains(t, string(run.Shell), `"Type":"File"`)
+
+	assert.Equal(t, map[string]bool{"json": true}, ast.Children[2].Attributes)
+	assert.Nil(t, ast.Children[2].Shell)
+
+	onbuild := ast.Children[3]
+	assert.Empty(t, onbuild.Args)
+	require.Len(t, onbuild.Children, 1)
+	assert.Equal(t, []string{"x"}, onbuild.Children[0].Args)
+
+	heredoc := ast.Children[4]
+	assert.Equal(t, []ASTHeredoc{{Name: "EOF", Content: "echo $(\n", Expand: true}}, heredoc.Heredocs)
+	assert.Nil(t, heredoc.Shell)
+	assert.NotEmpty(t, heredoc.ShellError)
+
+	_, err = ParseAST([]byte("RUN <<EOF\n"), ASTOptions{})
+	assert.Error(t, err)
+}
+
+func TestASTWriteTree(t *testing.T) {
+	ast, err := ParseAST([]byte("FROM alpine\nCOPY --chmod=644 a \\\n  b\nONBUILD RUN x\n"), ASTOptions{})
+	require.NoError(t, err)
+	var b strings.Builder
+	require.NoError(t, ast.WriteTree(&b))
+	expected := `FROM (line 1)
+  arg "alpine"
+COPY (lines 2-3)
+  flag "--chmod=644"
+  arg "a"
+  arg "b"
+ONBUILD (line 4)
+  RUN
+    arg "x"
+`
+	assert.Equal(t, expected, b.String())
+}
+
+// --- Markdown ---
+
+func TestFormatMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		errLines []int
+	}{
+		{
+			"dockerfile block",
+			"# Title\n\n```dockerfile\nfrom a\nrun echo a &&   echo b\n```\n",
+			"# Title\n\n```dockerfile\nFROM a\nRUN echo a && echo b\n```\n",
+			nil,
+		},
+		{
+			"info string is case-insensitive",
+			"~~~ Containerfile title=x\nfrom a\n~~~\n",
+			"~~~ Containerfile title=x\nFROM a\n~~~\n",
+			nil,
+		},
+		{
+			"indented in a list",
+			"1. Build:\n\n   ```Dockerfile\n   from a\n\n   run   echo hi\n   ```\n",
+			"1. Build:\n\n   ```Dockerfile\n   FROM a\n\n   RUN echo hi\n   ```\n",
+			nil,
+		},
+		{
+			"other languages",
+			"```bash\necho   hi\n```\n```\nfrom a\n```\n",
+			"```bash\necho   hi\n```\n```\nfrom a\n```\n",
+			nil,
+		},
+		{
+			"nested fence",
+			"````markdown\n```dockerfile\nfrom a\n```\n````\n````dockerfile\nfrom a\n```\n````\n",
+			"````markdown\n```dockerfile\nfrom a\n```\n````\n````dockerfile\nFROM a\n```\n````\n",
+			nil,
+		},
+		{
+			"unclosed fence",
+			"```dockerfile\nfrom a\n",
+			"```dockerfile\nfrom a\n",
+			nil,
+		},
+		{
+			"invalid block left as is",
+			"text\n\n```dockerfile\nFROM a\nRUN <<EOF\n```\n\n```dockerfile\nfrom b\n```\n",
+			"text\n\n```dockerfile\nFROM a\nRUN <<EOF\n```\n\n```dockerfile\nFROM b\n```\n",
+			[]int{5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, blocks := NewFormatter(&Config{IndentSize: 4}).FormatMarkdown([]byte(tt.input))
+			assert.Equal(t, tt.expected, string(out))
+			var errLines []int
+			for _, b := range blocks {
+				if b.Err != nil {
+					errLines = append(errLines, b.ErrorLine())
+				}
+			}
+			assert.Equal(t, tt.errLines, errLines)
+		})
+	}
+}
+
+// --- Compose and bake files ---
+
+func TestFormatCompose(t *testing.T) {
+	input := `services:
+  app:
+    build:
+      dockerfile_inline: |
+        from alpine
+        run echo a &&   echo b
+
+      target: x
+  stripped:
+    build:
+      dockerfile_inline: |-
+        from alpine
+  formatted:
+    build:
+      dockerfile_inline: |
+        FROM alpine
+  quoted:
+    build:
+      dockerfile_inline: "from alpine"
+  folded:
+    build:
+      dockerfile_inline: >
+        from alpine
+  broken:
+    build:
+      dockerfile_inline: |
+        FROM alpine
+        RUN <<EOF
+x-other:
+  dockerfile_inline: |
+    from alpine
+`
+	expected := `services:
+  app:
+    build:
+      dockerfile_inline: |
+        FROM alpine
+        RUN echo a && echo b
+
+      target: x
+  stripped:
+    build:
+      dockerfile_inline: |-
+        FROM alpine
+  formatted:
+    build:
+      dockerfile_inline: |
+        FROM alpine
+  quoted:
+    build:
+      dockerfile_inline: "from alpine"
+  folded:
+    build:
+      dockerfile_inline: >
+        from alpine
+  broken:
+    build:
+      dockerfile_inline: |
+        FROM alpine
+        RUN <<EOF
+x-other:
+  dockerfile_inline: |
+    from alpine
+`
+	out, blocks, err := NewFormatter(&Config{IndentSize: 4}).FormatCompose([]byte(input))
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(out))
+	require.Len(t, blocks, 6)
+	for i, line := range []int{5, 12, 16, 19, 22} {
+		assert.Equal(t, line, blocks[i].Line)
+		assert.NoError(t, blocks[i].Err)
+		assert.Equal(t, i < 2, blocks[i].Changed)
+		assert.Equal(t, i >= 3, blocks[i].Skipped)
+	}
+	assert.Error(t, blocks[5].Err)
+	assert.Equal(t, 28, blocks[5].ErrorLine())
+
+	_, _, err = NewFormatter(&Config{}).FormatCompose([]byte("services: ["))
+	assert.Error(t, err)
+}
+
+func TestFormatBakeHCL(t *testing.T) {
+	input := "target \"a\" {\n  dockerfile-inline = <<EOT\nfrom alpine\nrun echo ${VAR}\nEOT\n}\ntarget \"b\" {\n  dockerfile-inline = <<-EOT\n    FROM alpine\n\n    run   echo hi\n  EOT\n  tags = [\"b\"]\n}\n"
+	expected := "target \"a\" {\n  dockerfile-inline = <<EOT\nFROM alpine\nRUN echo ${VAR}\nEOT\n}\ntarget \"b\" {\n  dockerfile-inline = <<-EOT\n    FROM alpine\n\n    RUN echo hi\n  EOT\n  tags = [\"b\"]\n}\n"
+	out, blocks := NewFormatter(&Config{IndentSize: 4}).FormatBakeHCL([]byte(input))
+	assert.Equal(t, expected, string(out))
+	require.Len(t, blocks, 2)
+	assert.Equal(t, 3, blocks[0].Line)
+	assert.Equal(t, 9, blocks[1].Line)
+	assert.True(t, blocks[0].Changed && blocks[1].Changed)
+}
+
+func TestFormatBakeJSON(t *testing.T) {
+	input := `{
+  "target": {
+    "a": {"dockerfile-inline": "from alpine\nrun echo a &&   echo b", "tags": ["a"]},
+    "b": {"args": {"dockerfile-inline": "from b"}, "dockerfile-inline": "FROM b\n"}
+  }
+}
+`
+	expected := `{
+  "target": {
+    "a": {"dockerfile-inline": "FROM alpine\nRUN echo a && echo b", "tags": ["a"]},
+    "b": {"args": {"dockerfile-inline": "from b"}, "dockerfile-inline": "FROM b\n"}
+  }
+}
+`
+	out, blocks, err := NewFormatter(&Config{IndentSize: 4}).FormatBakeJSON([]byte(input))
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(out))
+	require.Len(t, blocks, 2)
+	assert.Equal(t, 3, blocks[0].Line)
+	assert.True(t, blocks[0].Changed)
+	assert.Equal(t, 4, blocks[1].Line)
+	assert.False(t, blocks[1].Changed)
+
+	_, _, err = NewFormatter(&Config{}).FormatBakeJSON([]byte(`{"target": `))
+	assert.Error(t, err)
+}
+
+// --- .dockerignore ---
+
+func TestFormatDockerignore(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		input    string
+		expected string
+	}{
+		{
+			name:     "trims and cleans patterns",
+			input:    "  ./dist/  \n! /build//out/\t\n/vendor\n",
+			expected: "dist\n!/build/out\n/vendor\n",
+		},
+		{
+			name:     "collapses blank lines",
+			input:    "\n\n# deps   \nnode_modules\n\n\n\n*.log\n\n",
+			expected: "# deps\nnode_modules\n\n*.log\n",
+		},
+		{
+			name:     "keeps indented hash as a pattern",
+			input:    "  # not a comment  \n#comment\n",
+			expected: "  # not a comment\n#comment\n",
+		},
+		{
+			name:     "comment space",
+			config:   Config{CommentSpace: true},
+			input:    "#comment\n####\n",
+			expected: "# comment\n####\n",
+		},
+		{
+			name:     "removes duplicates",
+			input:    "a\nb/\n!c\n./a\nb\n",
+			expected: "a\nb\n!c\n",
+		},
+		{
+			name:     "keeps duplicates after an overlapping exception",
+			input:    "build\n!build/keep\nbuild\n",
+			expected: "build\n!build/keep\nbuild\n",
+		},
+		{
+			name:     "sorts patterns of the same kind",
+			config:   Config{SortDockerignore: true},
+			input:    "# group\nzz\naa\n!aa/keep\nmm\nbb\n\ny\nx\n",
+			expected: "# group\naa\nzz\n!aa/keep\nbb\nmm\n\nx\ny\n",
+		},
+		{
+			name:     "keeps CRLF",
+			input:    "a/\r\n\r\n\r\nb\r\n",
+			expected: "a\r\n\r\nb\r\n",
+		},
+		{
+			name:     "empty",
+			input:    "\n\n",
+			expected: "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.TrailingNewline = true
+			out := NewFormatter(&tc.config).FormatDockerignore([]byte(tc.input))
+			assert.Equal(t, tc.expected, string(out))
+			again := NewFormatter(&tc.config).FormatDockerignore(out)
+			assert.Equal(t, string(out), string(again), "not idempotent")
+		})
+	}
+}
+
+func TestLintDockerignore(t *testing.T) {
+	input := `# deps
+node_modules
+*.log
+!important.log
+!README.md
+  #x
+!
+[
+../secret
+build
+!build
+tmp
+!tmp/keep
+src/**/gen
+!src/keep
+`
+	var got []string
+	for _, d := range LintDockerignore([]byte(input)) {
+		got = append(got, fmt.Sprintf("%d %s", d.Line, d.Rule))
+	}
+	assert.Equal(t, []string{
+		"5 UnusedIgnoreException",
+		"6 IndentedIgnoreComment",
+		"7 InvalidIgnorePattern",
+		"8 InvalidIgnorePattern",
+		"9 IgnorePatternOutsideContext",
+		"10 ShadowedIgnorePattern",
+	}, got)
+	assert.Empty(t, LintDockerignore([]byte("a/b\n!a/b/c\n!a/*/*.md\n")))
+}
+
 // --- FormatNode: unknown command ---
 
 func TestFormatNodeUnknownCommand(t *testing.T) {
@@ -586,3 +1711,71 @@ func TestIgnoreDirective(t *testing.T) {
 	expected := "FROM scratch\n# dockerfmt-ignore\nRUN   echo   hello\nRUN echo world\n"
 	assert.Equal(t, expected, output)
 }
+
+// --- Fuzzing ---
+
+func isBinary(r rune) bool {
+	return unicode.IsControl(r) && r != '\n' && r != '\t'
+}
+
+// FuzzFormatFileLines checks that formatting any Dockerfile buildkit accepts
+// doesn't panic, produces output buildkit still accepts, and is idempotent.
+// Crashers should be added to tests/in as regression goldens.
+func FuzzFormatFileLines(f *testing.F) {
+	seeds, err := filepath.Glob("../tests/in/*.dockerfile")
+	require.NoError(f, err)
+	for _, seed := range seeds {
+		b, err := os.ReadFile(seed)
+		require.NoError(f, err)
+		f.Add(string(b))
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		// Only text is meaningful: buildkit re-encodes invalid UTF-8 in flags,
+		// and control characters aren't preserved. CRs are only line endings.
+		text := strings.TrimSuffix(strings.ReplaceAll(input, "\r\n", "\n"), "\r")
+		if !utf8.ValidString(input) || strings.ContainsFunc(text, isBinary) {
+			t.Skip()
+		}
+		if _, err := parser.Parse(strings.NewReader(input)); err != nil {
+			t.Skip()
+		}
+		formatted := formatDockerfile(input, defaultConfig)
+		if _, err := parser.Parse(strings.NewReader(formatted)); err != nil {
+			t.Fatalf("formatted output doesn't parse: %v\n%s", err, formatted)
+		}
+		again := formatDockerfile(formatted, defaultConfig)
+		assert.Equal(t, formatted, again, "formatting should be idempotent")
+	})
+}
+
+// --- Benchmarks ---
+
+// generateDockerfile returns a multi-stage Dockerfile with about n directives,
+// mixing the directive kinds, comments and blank lines of a typical file.
+func generateDockerfile(n int) []string {
+	var b strings.Builder
+	for i := 0; b.Len() == 0 || i < n; i += 8 {
+		fmt.Fprintf(&b, "FROM alpine:3.%d AS stage%d\n", i%20, i)
+		fmt.Fprintf(&b, "# stage %d\n", i)
+		fmt.Fprintf(&b, "ARG VERSION_%d=1.%d\n", i, i)
+		fmt.Fprintf(&b, "env KEY_%d value%d\n", i, i)
+		b.WriteString("RUN --mount=type=cache,target=/var/cache/apk apk add --no-cache \\\n    curl \\\n    git && \\\n  echo done>/tmp/log\n\n")
+		fmt.Fprintf(&b, "COPY --from=stage%d /app /app\n", i)
+		b.WriteString("WORKDIR /app\n")
+		b.WriteString(`CMD ["sh","-c","echo hi"]` + "\n")
+	}
+	return strings.SplitAfter(b.String(), "\n")
+}
+
+func BenchmarkFormatFileLines(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		lines := generateDockerfile(n)
+		b.Run(fmt.Sprintf("directives=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				FormatFileLines(lines, defaultConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"log"
+	"maps"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// DirectiveFormatter formats a single directive, returning its text including
+// the trailing newline.
+type DirectiveFormatter func(n *ExtendedNode, c *Config) string
+
+// PreHook runs before a directive is formatted and may modify the node.
+type PreHook func(n *ExtendedNode, c *Config)
+
+// PostHook runs after a directive is formatted and returns the output to use.
+type PostHook func(n *ExtendedNode, c *Config, output string) string
+
+// Formatter formats Dockerfiles with its own set of directive formatters and
+// hooks, so callers can override or wrap how individual directives are
+// formatted without affecting other Formatter instances.
+type Formatter struct {
+	Config *Config
+
+	formatters map[string]DirectiveFormatter
+	preHooks   []PreHook
+	postHooks  []PostHook
+}
+
+// DefaultFormatters returns a copy of the built-in directive formatters, keyed
+// by lowercase directive name (e.g. "run").
+func DefaultFormatters() map[string]DirectiveFormatter {
+	return maps.Clone(defaultFormatters)
+}
+
+// NewFormatter returns a Formatter using c and the built-in directive
+// formatters.
+func NewFormatter(c *Config) *Formatter {
+	f := &Formatter{
+		Config:     c,
+		formatters: DefaultFormatters(),
+	}
+	// ONBUILD formats the directive it wraps, which must go through this
+	// Formatter's registry rather than the built-in one.
+	f.formatters[command.Onbuild] = func(n *ExtendedNode, c *Config) string {
+		return formatOnBuild(n, c, func(inner *ExtendedNode, c *Config) (string, bool) {
+			return f.formatNode(inner, c)
+		})
+	}
+	return f
+}
+
+// Register sets the formatter for a directive (e.g. "LABEL"), replacing any
+// existing one. Use Lookup first to delegate to the previous formatter.
+func (f *Formatter) Register(directive string, fn DirectiveFormatter) {
+	f.formatters[strings.ToLower(directive)] = fn
+}
+
+// Lookup returns the formatter currently registered for a directive, or nil.
+func (f *Formatter) Lookup(directive string) DirectiveFormatter {
+	return f.formatters[strings.ToLower(directive)]
+}
+
+// Wrap replaces the formatter for a directive with wrap(current). The current
+// formatter may be nil if none is registered.
+func (f *Formatter) Wrap(directive string, wrap func(next DirectiveFormatter) DirectiveFormatter) {
+	f.Register(directive, wrap(f.Lookup(directive)))
+}
+
+// AddPreHook adds a hook that runs before every directive is formatted.
+func (f *Formatter) AddPreHook(h PreHook) {
+	f.preHooks = append(f.preHooks, h)
+}
+
+// AddPostHook adds a hook that runs on the output of every formatted directive.
+func (f *Formatter) AddPostHook(h PostHook) {
+	f.postHooks = append(f.postHooks, h)
+}
+
+// FormatNode formats a single directive, running the pre and post hooks. It
+// returns false for directives without a registered formatter.
+func (f *Formatter) FormatNode(n *ExtendedNode) (string, bool) {
+	return f.formatNode(n, f.Config)
+}
+
+func (f *Formatter) formatNode(n *ExtendedNode, c *Config) (string, bool) {
+	fmtFunc := f.formatters[strings.ToLower(n.Value)]
+	if fmtFunc == nil {
+		return "", false
+	}
+	for _, h := range f.preHooks {
+		h(n, c)
+	}
+	output := fmtFunc(n, c)
+	for _, h := range f.postHooks {
+		output = h(n, c, output)
+	}
+	return output, true
+}
+
+// Format reads a Dockerfile from r and writes the formatted file to w. The
+// whole file is read before anything is written. It stops with ctx's error if
+// ctx is canceled while formatting.
+func (f *Formatter) Format(ctx context.Context, r io.Reader, w io.Writer) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	output, err := f.format(ctx, strings.SplitAfter(string(src), "\n"))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, output)
+	return err
+}
+
+// FormatBytes formats the Dockerfile in src.
+func (f *Formatter) FormatBytes(src []byte) ([]byte, error) {
+	output, err := f.format(context.Background(), strings.SplitAfter(string(src), "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
+
+// FormatFileLines formats a Dockerfile given as lines that keep their trailing
+// newlines (see strings.SplitAfter). It exits the program if the file can't be
+// parsed; use FormatBytes to get the error instead.
+func (f *Formatter) FormatFileLines(fileLines []string) string {
+	output, err := f.format(context.Background(), fileLines)
+	if err != nil {
+		log.Printf("%s\n", strings.Join(fileLines, ""))
+		log.Fatalf("Error parsing file: %v", err)
+	}
+	return output
+}
+
+func (f *Formatter) format(ctx context.Context, fileLines []string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c := f.Config
+	src, enc := normalizeSource(strings.Join(fileLines, ""), c)
+	fileLines = strings.SplitAfter(src, "\n")
+	result, err := parser.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+
+	parseState := &ParseState{
+		AllOriginalLines: fileLines,
+		Config:           c,
+		ctx:              ctx,
+		formatter:        f,
+	}
+	rootNode := BuildExtendedNode(result.AST, fileLines)
+	if c.Enabled(RuleStageNameCasing) {
+		normalizeStageNames(rootNode)
+	}
+	markBeforeFrom(rootNode)
+	// Moving MAINTAINER would touch lines outside the ranges being formatted.
+	if c.Enabled(RuleMaintainerToLabel) && len(c.LineRanges) == 0 {
+		relocateMaintainers(rootNode, fileLines)
+	}
+	parseState.processNode(rootNode)
+	if parseState.err != nil {
+		return "", parseState.err
+	}
+
+	// Append any trailing comments after the last directive.
+	if parseState.CurrentLine < len(parseState.AllOriginalLines) {
+		rest := parseState.AllOriginalLines[parseState.CurrentLine:]
+		if c.outsideRanges(parseState.CurrentLine+1, len(parseState.AllOriginalLines)) {
+			parseState.Output.WriteString(strings.Join(rest, ""))
+		} else {
+			parseState.Output.WriteString(parseState.formatComments(rest))
+		}
+	}
+
+	output := strings.TrimRight(parseState.Output.String(), "\n")
+	if c.TrailingNewline {
+		output += "\n"
+	}
+	return enc.restore(output), nil
+}
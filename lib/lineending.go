@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Line endings for Config.LineEnding.
+const (
+	// LineEndingAuto keeps the line ending of the first line of the input.
+	LineEndingAuto = "auto"
+	LineEndingLF   = "lf"
+	LineEndingCRLF = "crlf"
+)
+
+const utf8BOM = "\ufeff"
+
+var reTrailingCRs = regexp.MustCompile(`\r+\n`)
+
+// sourceEncoding records how the input was encoded so the output can be
+// written back the same way.
+type sourceEncoding struct {
+	bom  bool
+	crlf bool
+}
+
+// normalizeSource strips a UTF-8 BOM from src and converts CRLF line endings
+// to LF, so the formatter only ever sees LF.
+func normalizeSource(src string, c *Config) (string, sourceEncoding) {
+	var enc sourceEncoding
+	src, enc.bom = strings.CutPrefix(src, utf8BOM)
+	enc.bom = enc.bom && !c.StripBOM
+
+	switch c.LineEnding {
+	case LineEndingLF:
+	case LineEndingCRLF:
+		enc.crlf = true
+	default:
+		first, _, _ := strings.Cut(src, "\n")
+		enc.crlf = strings.HasSuffix(first, "\r") && strings.Contains(src, "\n")
+	}
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	// A CR at the end of the input is a line ending whose LF was cut off.
+	if trimmed, ok := strings.CutSuffix(src, "\r"); ok {
+		src = trimmed + "\n"
+	}
+	return src, enc
+}
+
+// restore applies the input's encoding to formatted output. Stray CRs left
+// before a line ending (e.g. once the spaces after them are trimmed) are
+// dropped, so every line ends the same way.
+func (enc sourceEncoding) restore(output string) string {
+	output = reTrailingCRs.ReplaceAllString(output, "\n")
+	if enc.crlf {
+		output = strings.ReplaceAll(output, "\n", "\r\n")
+	}
+	if enc.bom {
+		output = utf8BOM + output
+	}
+	return output
+}
@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/linter"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// Diagnostic is a problem buildkit reports in a Dockerfile that doesn't stop
+// it from building, such as an empty continuation line or a lint finding.
+type Diagnostic struct {
+	// Line and EndLine are the 1-based lines the diagnostic covers, or 0 if
+	// it isn't tied to a line.
+	Line    int
+	EndLine int
+	// Rule is the buildkit check that reported the diagnostic (e.g.
+	// "StageNameCasing"), or empty for parser warnings.
+	Rule    string
+	Message string
+	URL     string
+}
+
+// Lint parses src and returns buildkit's parser warnings and build check
+// findings, and the RUN --mount flags the formatter couldn't normalize,
+// ordered by line.
+func Lint(src []byte) ([]Diagnostic, error) {
+	result, err := parser.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var diagnostics []Diagnostic
+	for _, w := range result.Warnings {
+		d := Diagnostic{Message: w.Short, URL: w.URL}
+		if w.Location != nil {
+			d.Line, d.EndLine = w.Location.Start.Line, w.Location.End.Line
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	diagnostics = append(diagnostics, mountDiagnostics(result.AST)...)
+
+	lint := linter.New(&linter.Config{
+		Warn: func(rule, _, url, msg string, location []parser.Range) {
+			d := Diagnostic{Rule: rule, Message: msg, URL: url}
+			if len(location) > 0 {
+				d.Line, d.EndLine = location[0].Start.Line, location[len(location)-1].End.Line
+			}
+			diagnostics = append(diagnostics, d)
+		},
+	})
+	if _, _, err := instructions.Parse(result.AST, lint); err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(diagnostics, func(a, b Diagnostic) int {
+		return a.Line - b.Line
+	})
+	return diagnostics, nil
+}
+
+// LintMounts parses src and returns the RUN --mount flags that are invalid,
+// which the formatter leaves as written.
+func LintMounts(src []byte) ([]Diagnostic, error) {
+	result, err := parser.Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return mountDiagnostics(result.AST), nil
+}
+
+// mountDiagnostics reports the invalid RUN --mount flags of the directives of
+// root.
+func mountDiagnostics(root *parser.Node) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, node := range root.Children {
+		if !strings.EqualFold(node.Value, "run") {
+			continue
+		}
+		for _, flag := range node.Flags {
+			if _, err := normalizeMountFlag(flag); err != nil {
+				diagnostics = append(diagnostics, Diagnostic{
+					Line:    node.StartLine,
+					EndLine: node.EndLine,
+					Rule:    "InvalidMount",
+					Message: fmt.Sprintf("Invalid mount %q: %v", flag, err),
+				})
+			}
+		}
+	}
+	return diagnostics
+}
+
+// ErrorLine returns the 1-based line buildkit attached to a parse error from
+// Lint or Formatter.FormatBytes, or 0 if the error has no location.
+func ErrorLine(err error) int {
+	var el *parser.ErrorLocation
+	if !errors.As(err, &el) || len(el.Locations) == 0 || len(el.Locations[0]) == 0 {
+		return 0
+	}
+	return el.Locations[0][0].Start.Line
+}
@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+)
+
+// maintainerLabelKey is the OCI annotation that replaces the deprecated
+// MAINTAINER directive.
+const maintainerLabelKey = "org.opencontainers.image.authors"
+
+// relocateMaintainers plans the MAINTAINER → LABEL upgrade for the top-level
+// directives of root. Each MAINTAINER is merged into the nearest LABEL of its
+// stage when that doesn't change which directive sets the authors label last.
+// Otherwise a MAINTAINER before the first FROM is moved after that FROM, since
+// Docker rejects a LABEL outside a stage, and any other MAINTAINER after the
+// first FROM is rewritten in place by formatMaintainer.
+func relocateMaintainers(root *ExtendedNode, fileLines []string) {
+	// Split the directives into stages; stage 0 holds anything before the first FROM.
+	stages := [][]*ExtendedNode{nil}
+	ignored := map[*ExtendedNode]bool{}
+	prevEnd := 0
+	for _, child := range root.Children {
+		if child.StartLine > 0 {
+			ignored[child] = hasIgnoreComment(fileLines[prevEnd : child.StartLine-1])
+			prevEnd = child.EndLine
+		}
+		if strings.EqualFold(child.Value, command.From) {
+			stages = append(stages, nil)
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], child)
+	}
+
+	for i, stage := range stages {
+		for j, n := range stage {
+			if !strings.EqualFold(n.Value, command.Maintainer) || n.Next == nil || ignored[n] {
+				continue
+			}
+			// A MAINTAINER before the first FROM takes effect at the start of
+			// the first stage.
+			target, at := stage, j
+			if i == 0 {
+				if len(stages) < 2 {
+					continue
+				}
+				target, at = stages[1], 0
+			}
+			label := mergeableLabel(target, at, ignored)
+			switch {
+			case label != nil:
+				label.extraLabels = append(label.extraLabels, maintainerLabel(n.Next.Value))
+			case i == 0:
+				target[0].extraLabels = append(target[0].extraLabels, maintainerLabel(n.Next.Value))
+			default:
+				continue
+			}
+			n.relocated = true
+		}
+	}
+}
+
+// markBeforeFrom marks the top-level directives of root that come before the
+// first FROM. A fragment without any FROM is left unmarked.
+func markBeforeFrom(root *ExtendedNode) {
+	for i, child := range root.Children {
+		if strings.EqualFold(child.Value, command.From) {
+			for _, n := range root.Children[:i] {
+				n.beforeFrom = true
+			}
+			return
+		}
+	}
+}
+
+// mergeableLabel returns the LABEL directive of a stage that the authors label
+// of a MAINTAINER at index at can be appended to, or nil. The nearest LABEL
+// before it is preferred, then the nearest one after it. Neither may be
+// separated from the MAINTAINER by another directive that sets the authors
+// label, and a LABEL after it may not set that label itself, since the
+// appended pair would then override it.
+func mergeableLabel(stage []*ExtendedNode, at int, ignored map[*ExtendedNode]bool) *ExtendedNode {
+	canMerge := func(n *ExtendedNode) bool {
+		return strings.EqualFold(n.Value, command.Label) && len(n.Heredocs) == 0 && !ignored[n]
+	}
+	// The stage's FROM at index 0 is skipped.
+	for k := at - 1; k > 0; k-- {
+		n := stage[k]
+		if canMerge(n) {
+			return n
+		}
+		if setsAuthors(n) && !n.relocated {
+			return nil
+		}
+	}
+	for _, n := range stage[at+1:] {
+		if setsAuthors(n) {
+			return nil
+		}
+		if canMerge(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// setsAuthors reports whether n is a MAINTAINER or a LABEL that may set the
+// authors label. A key with a variable reference may be any key.
+func setsAuthors(n *ExtendedNode) bool {
+	switch {
+	case strings.EqualFold(n.Value, command.Maintainer):
+		return true
+	case !strings.EqualFold(n.Value, command.Label):
+		return false
+	}
+	unquote := strings.NewReplacer(`"`, "", `'`, "", `\`, "")
+	// The pairs are parsed as key, value and separator nodes.
+	for key := n.Next; key != nil; {
+		if k := unquote.Replace(key.Value); k == maintainerLabelKey || strings.Contains(k, "$") {
+			return true
+		}
+		if key.Next == nil || key.Next.Next == nil {
+			break
+		}
+		key = key.Next.Next.Next
+	}
+	return false
+}
+
+// maintainerLabel returns the key="value" label pair for a MAINTAINER value.
+func maintainerLabel(maintainer string) string {
+	return maintainerLabelKey + "=" + quoteLabelValue(unquoteMaintainer(maintainer))
+}
+
+// unquoteMaintainer strips one pair of quotes around a MAINTAINER value written
+// as a single quoted string, e.g. MAINTAINER "Jane Doe".
+func unquoteMaintainer(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' && !strings.Contains(s[1:len(s)-1], "\"") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// quoteLabelValue double-quotes s for use as a LABEL value. Backslashes, quotes
+// and "$" are escaped, since MAINTAINER values are literal but LABEL values
+// are subject to variable expansion.
+func quoteLabelValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return "\"" + r.Replace(s) + "\""
+}
+
+// appendLabels adds the pairs to the formatted output of n: a LABEL directive
+// is extended in place, while any other directive is followed by a new LABEL.
+func appendLabels(n *ExtendedNode, output string, c *Config) string {
+	if len(n.extraLabels) == 0 {
+		return output
+	}
+	pairs := strings.Join(n.extraLabels, " ")
+	if !strings.EqualFold(n.Value, command.Label) {
+		return output + matchKeywordCase(command.Label, n.keyword(c)) + " " + pairs + "\n"
+	}
+	output = strings.TrimRight(output, "\n")
+	if strings.Contains(output, "\n") {
+		return output + " \\\n" + c.indent() + pairs + "\n"
+	}
+	return output + " " + pairs + "\n"
+}
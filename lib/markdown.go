@@ -0,0 +1,109 @@
+package lib
+
+import "strings"
+
+// markdownLanguages are the info strings (compared case-insensitively) of the
+// fenced code blocks FormatMarkdown formats.
+var markdownLanguages = []string{"dockerfile", "containerfile"}
+
+// markdownFence is an opening code fence.
+type markdownFence struct {
+	indent string
+	marker string
+	lang   string
+}
+
+// parseMarkdownFence parses line as an opening code fence of three or more
+// backticks or tildes, indented by any amount so fences inside lists count.
+func parseMarkdownFence(line string) (markdownFence, bool) {
+	text := strings.TrimRight(line, "\r\n")
+	rest := strings.TrimLeft(text, " \t")
+	if rest == "" || (rest[0] != '`' && rest[0] != '~') {
+		return markdownFence{}, false
+	}
+	n := len(rest) - len(strings.TrimLeft(rest, rest[:1]))
+	if n < 3 {
+		return markdownFence{}, false
+	}
+	info := strings.TrimSpace(rest[n:])
+	// The info string of a backtick fence can't contain backticks.
+	if rest[0] == '`' && strings.Contains(info, "`") {
+		return markdownFence{}, false
+	}
+	lang, _, _ := strings.Cut(info, " ")
+	return markdownFence{indent: text[:len(text)-len(rest)], marker: rest[:n], lang: lang}, true
+}
+
+// closes reports whether line is a closing fence for f.
+func (f markdownFence) closes(line string) bool {
+	rest := strings.TrimSpace(line)
+	return strings.HasPrefix(rest, f.marker) && strings.Trim(rest, f.marker[:1]) == ""
+}
+
+// FormatMarkdown formats the contents of the ```dockerfile and
+// ```containerfile code blocks in a Markdown document, keeping the indentation
+// of fences nested in lists, and reports each block it found. Blocks that
+// can't be formatted are left as they are.
+func (f *Formatter) FormatMarkdown(src []byte) ([]byte, []EmbeddedDockerfile) {
+	block := f.embeddedFormatter()
+
+	var out strings.Builder
+	var blocks []EmbeddedDockerfile
+	lines := strings.SplitAfter(string(src), "\n")
+	for i := 0; i < len(lines); i++ {
+		out.WriteString(lines[i])
+		fence, ok := parseMarkdownFence(lines[i])
+		if !ok {
+			continue
+		}
+
+		end := i + 1
+		for end < len(lines) && !fence.closes(lines[end]) {
+			end++
+		}
+		if end == len(lines) {
+			// An unclosed fence runs to the end of the document; leave it.
+			for _, line := range lines[i+1:] {
+				out.WriteString(line)
+			}
+			break
+		}
+
+		body := strings.Join(lines[i+1:end], "")
+		if fence.isDockerfile() {
+			formatted, e := block.formatEmbedded(fence.dedent(lines[i+1:end]), i+2)
+			if e.Changed {
+				body = indentLines(formatted, fence.indent)
+			}
+			blocks = append(blocks, e)
+		}
+		out.WriteString(body)
+		out.WriteString(lines[end])
+		i = end
+	}
+	return []byte(out.String()), blocks
+}
+
+// isDockerfile reports whether the fence's info string names a Dockerfile.
+func (f markdownFence) isDockerfile() bool {
+	for _, lang := range markdownLanguages {
+		if strings.EqualFold(f.lang, lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedent removes the fence's indentation, or as much of it as they have, from
+// the lines of its block.
+func (f markdownFence) dedent(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		if trimmed, ok := strings.CutPrefix(line, f.indent); ok {
+			b.WriteString(trimmed)
+		} else {
+			b.WriteString(strings.TrimLeft(line, " \t"))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+// RUN --mount values are CSV lists of key=value pairs (see buildkit's
+// instructions/commands_runmount.go). We parse just enough of that grammar to
+// normalize key aliases and emit the keys in a stable order.
+package lib
+
+import (
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const mountFlagPrefix = "--mount="
+
+// mountKeyAliases maps alternate spellings accepted by buildkit to the
+// canonical key we emit.
+var mountKeyAliases = map[string]string{
+	"dst":         "target",
+	"destination": "target",
+	"src":         "source",
+	"ro":          "readonly",
+	"rw":          "readwrite",
+}
+
+// mountKeyOrder is the canonical order of --mount keys. Keys not listed here
+// cannot appear, since buildkit rejects them.
+var mountKeyOrder = []string{
+	"type",
+	"id",
+	"from",
+	"source",
+	"target",
+	"readonly",
+	"readwrite",
+	"required",
+	"sharing",
+	"mode",
+	"uid",
+	"gid",
+	"size",
+	"env",
+}
+
+var mountTypes = []string{"bind", "cache", "tmpfs", "secret", "ssh"}
+
+// mountBareKeys are the keys that may be written without a value (e.g. "ro").
+var mountBareKeys = []string{"readonly", "readwrite", "required"}
+
+type mountField struct {
+	key   string
+	value string
+	bare  bool
+}
+
+// mountConflicts lists keys that set the same option, so their relative order
+// decides which value buildkit uses.
+var mountConflicts = [][]string{{"readonly", "readwrite"}}
+
+// normalizeMountFlag rewrites a single "--mount=..." flag with canonical keys in
+// canonical order. Flags that are not --mount flags are returned unchanged, as
+// are mounts that use variables or set an option more than once: buildkit
+// expands the variables before reading the keys, and the last setting of an
+// option wins, so reordering could change its value.
+func normalizeMountFlag(flag string) (string, error) {
+	spec, ok := strings.CutPrefix(flag, mountFlagPrefix)
+	if !ok || strings.Contains(spec, "$") {
+		return flag, nil
+	}
+
+	r := csv.NewReader(strings.NewReader(spec))
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse csv mounts: %w", err)
+	}
+	if len(records) != 1 {
+		return "", fmt.Errorf("expected a single line of mount options")
+	}
+
+	fields := make([]mountField, 0, len(records[0]))
+	seen := map[string]bool{}
+	for _, raw := range records[0] {
+		key, value, hasValue := strings.Cut(raw, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if alias, ok := mountKeyAliases[key]; ok {
+			key = alias
+		}
+		if !slices.Contains(mountKeyOrder, key) {
+			return "", fmt.Errorf("unexpected key '%s' in '%s'", key, raw)
+		}
+		if !hasValue && !slices.Contains(mountBareKeys, key) {
+			return "", fmt.Errorf("invalid field '%s' must be a key=value pair", raw)
+		}
+		if key == "type" && !slices.Contains(mountTypes, strings.ToLower(value)) {
+			return "", fmt.Errorf("unsupported mount type %q", value)
+		}
+		if seen[key] {
+			return flag, nil
+		}
+		seen[key] = true
+		fields = append(fields, mountField{key: key, value: value, bare: !hasValue})
+	}
+	for _, keys := range mountConflicts {
+		set := 0
+		for _, key := range keys {
+			if seen[key] {
+				set++
+			}
+		}
+		if set > 1 {
+			return flag, nil
+		}
+	}
+
+	slices.SortStableFunc(fields, func(a, b mountField) int {
+		return slices.Index(mountKeyOrder, a.key) - slices.Index(mountKeyOrder, b.key)
+	})
+
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		if f.bare {
+			parts[i] = f.key
+		} else {
+			parts[i] = quoteMountField(f.key + "=" + f.value)
+		}
+	}
+	return mountFlagPrefix + strings.Join(parts, ","), nil
+}
+
+// quoteMountField quotes a CSV field if it contains characters that would
+// otherwise split it.
+func quoteMountField(field string) string {
+	if !strings.ContainsAny(field, ",\"\n") {
+		return field
+	}
+	return "\"" + strings.ReplaceAll(field, "\"", "\"\"") + "\""
+}
@@ -0,0 +1,58 @@
+package lib
+
+// Names of the rewrites the formatter performs. Each can be switched on or off
+// through Config.Rules.
+const (
+	RuleUppercaseDirectives = "uppercase-directives"
+	RuleEnvKeyValue         = "env-key-value"
+	RuleMaintainerToLabel   = "maintainer-to-label"
+	RuleJSONSpacing         = "json-spacing"
+	RuleSplitMountFlags     = "split-mount-flags"
+	RuleNormalizeMounts     = "normalize-mounts"
+	RuleFromAsCasing        = "from-as-casing"
+	RuleStageNameCasing     = "stage-name-casing"
+	RulePlatformCasing      = "platform-casing"
+)
+
+// Rule describes a named rewrite and whether it is enabled by default.
+type Rule struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+// Rules lists every rule the formatter knows about.
+var Rules = []Rule{
+	{RuleUppercaseDirectives, "Uppercase directive keywords (run → RUN)", true},
+	{RuleEnvKeyValue, "Convert legacy ENV key value to ENV key=value", true},
+	{RuleMaintainerToLabel, "Upgrade MAINTAINER to an org.opencontainers.image.authors LABEL", true},
+	{RuleJSONSpacing, `Re-space JSON-form arrays as ["a", "b"]`, true},
+	{RuleSplitMountFlags, "Put each RUN flag on its own line when a --mount flag is present", true},
+	{RuleNormalizeMounts, "Normalize RUN --mount option keys and order", true},
+	{RuleFromAsCasing, "Match the casing of AS in FROM to the directive", true},
+	{RuleStageNameCasing, "Lowercase stage names and every reference to them", true},
+	{RulePlatformCasing, "Lowercase literal FROM --platform values", true},
+}
+
+// LookupRule returns the rule with the given name.
+func LookupRule(name string) (Rule, bool) {
+	for _, r := range Rules {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Enabled reports whether the named rule is enabled, falling back to the
+// rule's default when Config.Rules doesn't mention it.
+func (c *Config) Enabled(rule string) bool {
+	if rule == RuleMaintainerToLabel && c.KeepMaintainer {
+		return false
+	}
+	if on, ok := c.Rules[rule]; ok {
+		return on
+	}
+	r, _ := LookupRule(rule)
+	return r.Default
+}
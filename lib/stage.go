@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"encoding/csv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+)
+
+// stageNames returns the set of build stage names declared with
+// "FROM <image> AS <name>", keyed by their lowercase form.
+func stageNames(root *ExtendedNode) map[string]bool {
+	stages := map[string]bool{}
+	for _, child := range root.Children {
+		if name, ok := fromStageName(child); ok {
+			stages[strings.ToLower(name.Value)] = true
+		}
+	}
+	return stages
+}
+
+// fromStageName returns the node holding the stage name of a FROM directive,
+// if it declares one.
+func fromStageName(n *ExtendedNode) (*ExtendedNode, bool) {
+	if !strings.EqualFold(n.Value, command.From) || n.Next == nil {
+		return nil, false
+	}
+	as := n.Next.Next
+	if as == nil || !strings.EqualFold(as.Value, "as") || as.Next == nil {
+		return nil, false
+	}
+	return as.Next, true
+}
+
+// normalizeStageNames lowercases every stage name (buildkit's StageNameCasing
+// check) along with every reference to a stage: "FROM <stage>",
+// "COPY --from=<stage>" and "RUN --mount=from=<stage>". Stage names are
+// case-insensitive to buildkit, so this never changes which stage is used.
+// References that are not stage names (e.g. image names) are left alone.
+func normalizeStageNames(root *ExtendedNode) {
+	stages := stageNames(root)
+	if len(stages) == 0 {
+		return
+	}
+	rename := func(ref string) string {
+		if stages[strings.ToLower(ref)] {
+			return strings.ToLower(ref)
+		}
+		return ref
+	}
+
+	for _, child := range root.Children {
+		switch strings.ToLower(child.Value) {
+		case command.From:
+			if child.Next != nil {
+				child.Next.Value = rename(child.Next.Value)
+			}
+			if name, ok := fromStageName(child); ok {
+				name.Value = strings.ToLower(name.Value)
+			}
+		case command.Copy, command.Add:
+			for i, flag := range child.Flags {
+				if ref, ok := strings.CutPrefix(flag, "--from="); ok {
+					child.Flags[i] = "--from=" + rename(ref)
+				}
+			}
+		case command.Run:
+			for i, flag := range child.Flags {
+				child.Flags[i] = renameMountFrom(flag, rename)
+			}
+		}
+	}
+}
+
+// renameMountFrom applies rename to the from= field of a --mount flag. Flags
+// that can't be parsed are returned unchanged; normalizeMountFlag reports them.
+func renameMountFrom(flag string, rename func(string) string) string {
+	spec, ok := strings.CutPrefix(flag, mountFlagPrefix)
+	if !ok {
+		return flag
+	}
+	r := csv.NewReader(strings.NewReader(spec))
+	r.LazyQuotes = true
+	fields, err := r.Read()
+	if err != nil {
+		return flag
+	}
+	changed := false
+	for i, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || !strings.EqualFold(key, "from") {
+			continue
+		}
+		if renamed := rename(value); renamed != value {
+			fields[i] = key + "=" + renamed
+			changed = true
+		}
+	}
+	if !changed {
+		return flag
+	}
+	for i, field := range fields {
+		fields[i] = quoteMountField(field)
+	}
+	return mountFlagPrefix + strings.Join(fields, ",")
+}
+
+// formatFrom formats a FROM directive. The "AS" keyword follows the casing of
+// the directive itself (buildkit's FromAsCasing check), and literal --platform
+// values are lowercased, unless the corresponding rules are disabled.
+func formatFrom(n *ExtendedNode, c *Config) string {
+	if _, ok := fromStageName(n); ok && c.Enabled(RuleFromAsCasing) {
+		n.Next.Next.Value = matchKeywordCase("AS", n.keyword(c))
+	}
+	if c.Enabled(RulePlatformCasing) {
+		for i, flag := range n.Flags {
+			if value, ok := strings.CutPrefix(flag, "--platform="); ok && !strings.Contains(value, "$") {
+				n.Flags[i] = "--platform=" + strings.ToLower(value)
+			}
+		}
+	}
+	return spaceSeparated(collapseLines)(n, c)
+}
+
+// matchKeywordCase returns keyword in lowercase if directive is written in
+// lowercase, and uppercase otherwise.
+func matchKeywordCase(keyword, directive string) string {
+	if directive == strings.ToLower(directive) {
+		return strings.ToLower(keyword)
+	}
+	return strings.ToUpper(keyword)
+}
@@ -0,0 +1,502 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/command"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// VerifyError reports where a formatted Dockerfile stops being equivalent to
+// the original.
+type VerifyError struct {
+	// Line is the line of the divergent instruction in the original, or 0 if
+	// the divergence isn't tied to a single instruction.
+	Line      int
+	Reason    string
+	Original  string
+	Formatted string
+}
+
+func (e *VerifyError) Error() string {
+	msg := e.Reason
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	if e.Original != "" || e.Formatted != "" {
+		msg += fmt.Sprintf("\n  original:  %s\n  formatted: %s", e.Original, e.Formatted)
+	}
+	return msg
+}
+
+// Verify checks that formatted builds the same image as original, and that
+// formatting it again doesn't change it.
+func (f *Formatter) Verify(original, formatted string) error {
+	if err := CompareInstructions(original, formatted); err != nil {
+		return err
+	}
+	again, err := f.FormatBytes([]byte(formatted))
+	if err != nil {
+		return fmt.Errorf("formatting again: %w", err)
+	}
+	if string(again) != formatted {
+		return &VerifyError{Reason: "formatting is not idempotent", Original: firstDiffLine(formatted, string(again)), Formatted: firstDiffLine(string(again), formatted)}
+	}
+	return nil
+}
+
+// CompareInstructions parses both Dockerfiles with buildkit and compares the
+// resulting build stages and instructions: commands, flags, arguments,
+// heredoc bodies and the shell syntax trees of shell-form commands. Rewrites
+// the formatter makes on purpose, such as MAINTAINER → LABEL and stage name
+// casing, are normalized away before comparing. Directives buildkit can't
+// parse are compared as text, and flags it doesn't know as words, so
+// fragments and Dockerfiles using labs flags can be compared too.
+func CompareInstructions(original, formatted string) error {
+	want, err := canonicalStages(original)
+	if err != nil {
+		return fmt.Errorf("parsing original: %w", err)
+	}
+	got, err := canonicalStages(formatted)
+	if err != nil {
+		return fmt.Errorf("parsing formatted output: %w", err)
+	}
+
+	for i := range max(len(want), len(got)) {
+		if i >= len(want) || i >= len(got) {
+			return &VerifyError{Reason: fmt.Sprintf("stage count differs: %d != %d", len(want), len(got))}
+		}
+		if err := compareStage(want[i], got[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canonicalStage is a build stage reduced to the parts that affect the build.
+type canonicalStage struct {
+	header   canonicalInstruction
+	commands []canonicalInstruction
+	labels   map[string]string
+}
+
+type canonicalInstruction struct {
+	line  int
+	text  string
+	value any
+}
+
+func compareStage(want, got canonicalStage) error {
+	if !reflect.DeepEqual(want.header.value, got.header.value) {
+		return divergence(want.header, got.header)
+	}
+	for i := range max(len(want.commands), len(got.commands)) {
+		if i >= len(want.commands) {
+			return &VerifyError{Line: got.commands[i].line, Reason: "extra instruction", Formatted: got.commands[i].text}
+		}
+		if i >= len(got.commands) {
+			return &VerifyError{Line: want.commands[i].line, Reason: "missing instruction", Original: want.commands[i].text}
+		}
+		if !reflect.DeepEqual(want.commands[i].value, got.commands[i].value) {
+			return divergence(want.commands[i], got.commands[i])
+		}
+	}
+	if !reflect.DeepEqual(want.labels, got.labels) {
+		return &VerifyError{Line: want.header.line, Reason: fmt.Sprintf("labels differ: %v != %v", want.labels, got.labels)}
+	}
+	return nil
+}
+
+func divergence(want, got canonicalInstruction) error {
+	return &VerifyError{Line: want.line, Reason: "instruction differs", Original: want.text, Formatted: got.text}
+}
+
+// canonicalStages parses a Dockerfile into its canonical stages. A stage with
+// index 0 and no header holds what comes before the first FROM: the meta ARGs,
+// or all of a fragment that has no FROM.
+func canonicalStages(content string) ([]canonicalStage, error) {
+	result, err := parser.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	// The formatter re-indents the continuation lines of ENV, which also
+	// changes the blanks inside a quoted value; parse again without them.
+	if lines, ok := unindentEnvContinuations(content, result.AST); ok {
+		if result, err = parser.Parse(strings.NewReader(lines)); err != nil {
+			return nil, err
+		}
+	}
+
+	lex := shell.NewLex(result.EscapeToken)
+	c := &canonicalizer{lex: lex, stages: map[string]bool{}}
+	for _, n := range result.AST.Children {
+		if strings.EqualFold(n.Value, command.From) {
+			if s, err := instructions.ParseInstruction(n); err == nil {
+				if name := s.(*instructions.Stage).Name; name != "" {
+					c.stages[name] = true
+				}
+			}
+		}
+	}
+
+	out := []canonicalStage{{labels: map[string]string{}}}
+	for _, n := range result.AST.Children {
+		cmd, unknownFlags := parseInstruction(n)
+		cs := &out[len(out)-1]
+		switch cmd := cmd.(type) {
+		case nil:
+			// The formatter keeps directives buildkit rejects (e.g. unknown
+			// ones) as they are, so they are compared as text.
+			cs.commands = append(cs.commands, canonicalInstruction{line: n.StartLine, text: n.Original, value: unparsed(n)})
+		case *instructions.Stage:
+			out = append(out, canonicalStage{
+				header: canonicalInstruction{
+					line: startLine(cmd.Location),
+					text: cmd.SourceCode,
+					value: []any{
+						"FROM",
+						c.stageRef(cmd.BaseName),
+						c.platform(cmd.Platform),
+						cmd.Name,
+						c.words(unknownFlags),
+					},
+				},
+				labels: map[string]string{},
+			})
+		case *instructions.MaintainerCommand:
+			cs.labels[maintainerLabelKey] = unquoteMaintainer(cmd.Maintainer)
+		case *instructions.LabelCommand:
+			for _, kv := range cmd.Labels {
+				cs.labels[c.word(kv.Key)] = c.word(kv.Value)
+			}
+		case instructions.Command:
+			ci := c.instruction(cmd)
+			if len(unknownFlags) > 0 {
+				ci.value.(map[string]any)["UnknownFlags"] = c.words(unknownFlags)
+			}
+			cs.commands = append(cs.commands, ci)
+		}
+	}
+
+	// MAINTAINER before the first FROM is invalid to buildkit but is moved into
+	// the first stage by the formatter; do the same here.
+	if len(out) > 1 {
+		for key, value := range out[0].labels {
+			if _, ok := out[1].labels[key]; !ok {
+				out[1].labels[key] = value
+			}
+		}
+		clear(out[0].labels)
+	}
+	return out, nil
+}
+
+// reUnknownFlag matches buildkit's error for a flag it doesn't know.
+var reUnknownFlag = regexp.MustCompile(`unknown flag: (--\S+)`)
+
+// parseInstruction parses n with buildkit, or returns nil if it can't. Flags
+// that buildkit doesn't know, such as the labs flags COPY --parents and
+// --exclude that need a build tag, are accepted by the formatter like any
+// other, so they are removed from n and returned for comparing as words.
+func parseInstruction(n *parser.Node) (any, []string) {
+	var unknown []string
+	for {
+		cmd, err := instructions.ParseInstruction(n)
+		if err == nil {
+			return cmd, unknown
+		}
+		m := reUnknownFlag.FindStringSubmatch(err.Error())
+		if m == nil {
+			return nil, nil
+		}
+		var kept []string
+		for _, flag := range n.Flags {
+			if name, _, _ := strings.Cut(flag, "="); name == m[1] {
+				unknown = append(unknown, flag)
+			} else {
+				kept = append(kept, flag)
+			}
+		}
+		if len(kept) == len(n.Flags) {
+			return nil, nil
+		}
+		n.Flags = kept
+	}
+}
+
+// unparsed is the canonical value of a directive buildkit can't parse: its
+// text, ignoring the casing of the keyword and runs of whitespace, and its
+// heredoc bodies.
+func unparsed(n *parser.Node) any {
+	fields := strings.Fields(n.Original)
+	if len(fields) > 0 {
+		fields[0] = strings.ToUpper(fields[0])
+	}
+	value := []any{"unparsed", strings.Join(fields, " ")}
+	for _, h := range n.Heredocs {
+		value = append(value, h.Content)
+	}
+	return value
+}
+
+// unindentEnvContinuations returns content with the indentation of the
+// continuation lines of each ENV directive reduced to a single blank, and
+// whether anything changed.
+func unindentEnvContinuations(content string, root *parser.Node) (string, bool) {
+	lines := strings.SplitAfter(content, "\n")
+	changed := false
+	for _, n := range root.Children {
+		if !strings.EqualFold(n.Value, command.Env) {
+			continue
+		}
+		for i := n.StartLine; i < n.EndLine && i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " \t")
+			if trimmed != lines[i] && " "+trimmed != lines[i] {
+				lines[i] = " " + trimmed
+				changed = true
+			}
+		}
+	}
+	return strings.Join(lines, ""), changed
+}
+
+// canonicalizer turns parsed instructions into values that compare equal when
+// they build the same thing.
+type canonicalizer struct {
+	lex    *shell.Lex
+	stages map[string]bool
+}
+
+func (c *canonicalizer) instruction(cmd instructions.Command) canonicalInstruction {
+	ci := canonicalInstruction{text: fmt.Sprint(cmd)}
+	if loc, ok := cmd.(interface{ Location() []parser.Range }); ok {
+		ci.line = startLine(loc.Location())
+	}
+
+	// Resolve deferred flag parsing (e.g. --mount) without expanding variables.
+	if e, ok := cmd.(instructions.SupportsSingleWordExpansion); ok {
+		_ = e.Expand(func(word string) (string, error) { return word, nil })
+	}
+
+	var fields map[string]any
+	b, _ := json.Marshal(cmd)
+	_ = json.Unmarshal(b, &fields)
+	stripKeys(fields, "NoDelim")
+
+	switch cmd := cmd.(type) {
+	case *instructions.RunCommand:
+		fields["Mounts"] = c.mounts(instructions.GetMounts(cmd))
+		fields["Network"] = instructions.GetNetwork(cmd)
+		c.shellCommand(fields, cmd.ShellDependantCmdLine)
+	case *instructions.CmdCommand:
+		c.shellCommand(fields, cmd.ShellDependantCmdLine)
+	case *instructions.EntrypointCommand:
+		c.shellCommand(fields, cmd.ShellDependantCmdLine)
+	case *instructions.CopyCommand:
+		fields["From"] = c.stageRef(cmd.From)
+	case *instructions.EnvCommand:
+		// Quoting is evaluated when the value is set, so ENV A b c and
+		// ENV A="b c" are the same, as with LABEL.
+		env := make([]any, len(cmd.Env))
+		for i, kv := range cmd.Env {
+			env[i] = []string{c.word(kv.Key), c.word(kv.Value)}
+		}
+		fields["Env"] = env
+	case *instructions.ArgCommand:
+		// Comments before an ARG document it but don't affect the build.
+		args := make([]any, len(cmd.Args))
+		for i, kv := range cmd.Args {
+			if kv.Value == nil {
+				args[i] = []any{kv.Key}
+			} else {
+				args[i] = []any{kv.Key, c.word(*kv.Value)}
+			}
+		}
+		fields["Args"] = args
+	case *instructions.OnbuildCommand:
+		fields["Expression"] = c.onbuild(cmd.Expression)
+	}
+	ci.value = map[string]any{fmt.Sprintf("%T", cmd): fields}
+	return ci
+}
+
+// shellCommand replaces the command line and the shell heredoc bodies of a
+// shell-form command with their shell syntax trees, so layout and comments
+// don't count. Other heredocs must match byte for byte.
+func (c *canonicalizer) shellCommand(fields map[string]any, cmd instructions.ShellDependantCmdLine) {
+	if cmd.PrependShell && len(cmd.CmdLine) > 0 {
+		fields["CmdLine"] = canonicalShell(strings.Join(cmd.CmdLine, " "))
+	}
+	files := make([]any, len(cmd.Files))
+	for i, f := range cmd.Files {
+		data := f.Data
+		if cmd.PrependShell && heredocRunByShell(cmd.CmdLine, data) {
+			data = canonicalShell(data)
+		}
+		files[i] = []any{f.Name, f.Chomp, data}
+	}
+	fields["Files"] = files
+}
+
+// heredocRunByShell reports whether sh or bash runs the heredoc data of the
+// command line cmdLine. A command that is just a heredoc runs it as a script,
+// with the interpreter named by its "#!" line or else the shell; otherwise the
+// heredoc is the input of the command, which must be sh or bash.
+func heredocRunByShell(cmdLine []string, data string) bool {
+	words := strings.Fields(strings.Join(cmdLine, " "))
+	if len(words) == 0 {
+		return false
+	}
+	if len(words) == 1 && strings.HasPrefix(words[0], "<<") {
+		first, _, _ := strings.Cut(data, "\n")
+		interpreter, ok := strings.CutPrefix(first, "#!")
+		if !ok {
+			return true
+		}
+		words = strings.Fields(interpreter)
+		if len(words) > 1 && path.Base(words[0]) == "env" {
+			words = words[1:]
+		}
+		return len(words) > 0 && isPOSIXShell(words[0])
+	}
+	return isPOSIXShell(words[0])
+}
+
+// isPOSIXShell reports whether the program is sh or bash.
+func isPOSIXShell(program string) bool {
+	name := path.Base(program)
+	return name == "sh" || name == "bash"
+}
+
+func (c *canonicalizer) mounts(mounts []*instructions.Mount) any {
+	var out []any
+	for _, m := range mounts {
+		var fields map[string]any
+		b, _ := json.Marshal(m)
+		_ = json.Unmarshal(b, &fields)
+		fields["From"] = c.stageRef(m.From)
+		out = append(out, fields)
+	}
+	return out
+}
+
+// onbuild canonicalizes the directive wrapped by ONBUILD. Directives that
+// buildkit can't parse on their own are compared as text, ignoring the casing
+// of the keyword and runs of whitespace.
+func (c *canonicalizer) onbuild(expr string) any {
+	fields := strings.Fields(expr)
+	if len(fields) > 0 {
+		fields[0] = strings.ToUpper(fields[0])
+	}
+	text := strings.Join(fields, " ")
+
+	result, err := parser.Parse(strings.NewReader(expr))
+	if err != nil || len(result.AST.Children) != 1 {
+		return text
+	}
+	cmd, err := instructions.ParseCommand(result.AST.Children[0])
+	if err != nil {
+		return text
+	}
+	// ONBUILD runs in a downstream build, where our stage names mean nothing.
+	inner := &canonicalizer{lex: c.lex}
+	return inner.instruction(cmd).value
+}
+
+// stageRef lowercases references to build stages, which buildkit matches
+// case-insensitively.
+func (c *canonicalizer) stageRef(ref string) string {
+	if c.stages[strings.ToLower(ref)] {
+		return strings.ToLower(ref)
+	}
+	return ref
+}
+
+// platform lowercases literal platform values, which buildkit normalizes.
+func (c *canonicalizer) platform(p string) string {
+	if strings.Contains(p, "$") {
+		return p
+	}
+	return strings.ToLower(p)
+}
+
+// words applies word to each of ws.
+func (c *canonicalizer) words(ws []string) []string {
+	out := make([]string, len(ws))
+	for i, w := range ws {
+		out[i] = c.word(w)
+	}
+	return out
+}
+
+// word removes quoting and escapes the way buildkit does when it evaluates
+// a LABEL, but leaves variable references in place.
+func (c *canonicalizer) word(w string) string {
+	out, _, err := c.lex.ProcessWord(w, symbolicEnv{})
+	if err != nil {
+		return w
+	}
+	return out
+}
+
+// symbolicEnv resolves every variable to a placeholder naming it, so words
+// that reference different variables don't compare equal.
+type symbolicEnv struct{}
+
+func (symbolicEnv) Get(key string) (string, bool) { return "${" + key + "}", true }
+func (symbolicEnv) Keys() []string                { return nil }
+
+// canonicalShell returns the minified shell syntax of script, or script itself
+// if it isn't valid shell (e.g. a heredoc for another interpreter).
+func canonicalShell(script string) string {
+	f, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		return script
+	}
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter(syntax.Minify(true)).Print(&buf, f); err != nil {
+		return script
+	}
+	return buf.String()
+}
+
+func stripKeys(v any, key string) {
+	switch v := v.(type) {
+	case map[string]any:
+		delete(v, key)
+		for _, child := range v {
+			stripKeys(child, key)
+		}
+	case []any:
+		for _, child := range v {
+			stripKeys(child, key)
+		}
+	}
+}
+
+func startLine(loc []parser.Range) int {
+	if len(loc) == 0 {
+		return 0
+	}
+	return loc[0].Start.Line
+}
+
+// firstDiffLine returns the first line of a that differs from b.
+func firstDiffLine(a, b string) string {
+	al, bl := strings.Split(a, "\n"), strings.Split(b, "\n")
+	for i, line := range al {
+		if i >= len(bl) || line != bl[i] {
+			return line
+		}
+	}
+	return ""
+}